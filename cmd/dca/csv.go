@@ -0,0 +1,147 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+// fromCSV runs the fromcsv command, which encodes a CSV file as a ts table
+// defined in a schema stream. The links and tags other than hidden of the
+// schema are dropped, see the usage text.
+func fromCSV(args []string) error {
+	fs := flag.NewFlagSet("fromcsv", flag.ExitOnError)
+	schema := fs.String("schema", "", "ts stream with the table definition")
+	table := fs.String("table", "", "name of the table")
+	in := fs.String("in", "", "CSV file, defaults to standard input")
+	out := fs.String("out", "", "output ts file, defaults to standard output")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), `usage: dca fromcsv -schema file -table name [-in file] [-out file]
+
+Fromcsv writes the rows of a CSV file as the named table of the schema.
+The table is written without its links and without tags other than hidden,
+as they refer to other tables and tags of the schema stream.
+
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*schema) == 0 || len(*table) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*schema)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := ts.NewReader(f)
+	for r.Next() {
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	var def *ts.TableDef
+	for _, d := range r.Tables() {
+		if d.Name == *table {
+			d := d
+			def = &d
+		}
+	}
+	if def == nil {
+		return fmt.Errorf("table %q not in %s", *table, *schema)
+	}
+	cols := make([]ts.Col, len(def.Columns))
+	for i, c := range def.Columns {
+		// Links and defined tags refer to the schema stream.
+		var tags ts.Tags
+		for _, tag := range c.Tags {
+			if tag == ts.TagHidden {
+				tags = append(tags, tag)
+			}
+		}
+		c.Tags = tags
+		c.Link = 0
+		cols[i] = c
+	}
+
+	src, err := openIn(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createOut(*out)
+	if err != nil {
+		return err
+	}
+	w := ts.NewWriter(dst)
+	_, err = ts.FromCSV(w, src, ts.Table{Name: def.Name, Comment: def.Comment}, cols...)
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// toCSV runs the tocsv command, which writes a ts table as CSV.
+func toCSV(args []string) error {
+	fs := flag.NewFlagSet("tocsv", flag.ExitOnError)
+	table := fs.String("table", "", "name of the table")
+	hidden := fs.Bool("hidden", false, "include hidden columns")
+	in := fs.String("in", "", "ts file, defaults to standard input")
+	out := fs.String("out", "", "output CSV file, defaults to standard output")
+	fs.Parse(args)
+	if len(*table) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src, err := openIn(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createOut(*out)
+	if err != nil {
+		return err
+	}
+	err = ts.ToCSV(dst, src, *table, ts.CSVOptions{Hidden: *hidden})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openIn opens the named file, or standard input if name is empty.
+func openIn(name string) (io.ReadCloser, error) {
+	if len(name) == 0 {
+		return os.Stdin, nil
+	}
+	return os.Open(name)
+}
+
+// createOut creates the named file, or returns standard output if name is
+// empty. Closing standard output leaves it open.
+func createOut(name string) (io.WriteCloser, error) {
+	if len(name) == 0 {
+		return stdout{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+// stdout is standard output with a Close that does nothing.
+type stdout struct {
+	io.Writer
+}
+
+func (stdout) Close() error { return nil }
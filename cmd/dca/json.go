@@ -0,0 +1,61 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+// fromJSON runs the fromjson command, which encodes NDJSON as a ts stream.
+func fromJSON(args []string) error {
+	fs := flag.NewFlagSet("fromjson", flag.ExitOnError)
+	in := fs.String("in", "", "NDJSON file, defaults to standard input")
+	out := fs.String("out", "", "output ts file, defaults to standard output")
+	fs.Parse(args)
+
+	src, err := openIn(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createOut(*out)
+	if err != nil {
+		return err
+	}
+	w := ts.NewWriter(dst)
+	err = ts.FromJSON(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// toJSON runs the tojson command, which writes a ts stream as NDJSON.
+func toJSON(args []string) error {
+	fs := flag.NewFlagSet("tojson", flag.ExitOnError)
+	in := fs.String("in", "", "ts file, defaults to standard input")
+	out := fs.String("out", "", "output NDJSON file, defaults to standard output")
+	fs.Parse(args)
+
+	src, err := openIn(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createOut(*out)
+	if err != nil {
+		return err
+	}
+	err = ts.ToJSON(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -14,8 +14,23 @@ import (
 	"github.com/solidcoredata/dca/service/config"
 )
 
+// commands are run by name from the first argument. Without a command
+// the services are run.
+var commands = map[string]func(args []string) error{
+	"fromcsv":  fromCSV,
+	"fromjson": fromJSON,
+	"tocsv":    toCSV,
+	"tojson":   toJSON,
+}
+
 func main() {
 	flag.Parse()
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	err := start.Start(context.Background(), time.Second*5, run)
 	if err != nil {
 		log.Print(err)
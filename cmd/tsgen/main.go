@@ -0,0 +1,69 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command tsgen generates typed Go bindings for the tables of a ts stream
+// or of a schema definition in the let notation of package tstext.
+//
+// Use it from a go:generate directive:
+//
+//	//go:generate tsgen -in schema.ts -pkg model -out model_ts.go
+//	//go:generate tsgen -schema schema.let -pkg model -out model_ts.go
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/solidcoredata/dca/ts/tsgen"
+)
+
+func main() {
+	in := flag.String("in", "", "ts stream to read the table definitions from")
+	schema := flag.String("schema", "", "schema definition in the let notation to read the table definitions from")
+	pkg := flag.String("pkg", os.Getenv("GOPACKAGE"), "package name of the generated file")
+	out := flag.String("out", "", "output file, defaults to standard output")
+	flag.Parse()
+
+	if (len(*in) == 0) == (len(*schema) == 0) || len(*pkg) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	err := run(*in, *schema, *pkg, *out)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(in, schema, pkg, out string) error {
+	var s *tsgen.Schema
+	if len(schema) > 0 {
+		src, err := ioutil.ReadFile(schema)
+		if err != nil {
+			return err
+		}
+		if s, err = tsgen.ParseSchema(schema, string(src)); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if s, err = tsgen.ReadSchema(f); err != nil {
+			return err
+		}
+	}
+	src, err := tsgen.Generate(pkg, s)
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return ioutil.WriteFile(out, src, 0666)
+}
@@ -22,5 +22,12 @@ type TSMsg struct {
 	FirstMessage bool   // = 2
 	LastMessage  bool   // = 3
 	Cancel       bool   // = 4
+	Sequence     int64  // = 5 // Sequence number of the chunk, zero if none.
 	Chunk        []byte // = 10
 }
+
+// TSAck acknowledges the chunks of a stream up to and including Sequence.
+// A sender resumes a broken transfer after the last acknowledged chunk.
+type TSAck struct {
+	Sequence int64 // = 1
+}
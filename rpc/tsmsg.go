@@ -0,0 +1,256 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"io"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+// TSVersion is the Version sent in the first TSMsg of a stream.
+const TSVersion = "1"
+
+// TSMsgWriter is an io.Writer that splits a ts stream into TSMsg frames.
+// Each message holds one chunk, numbered from 1 in Sequence; the header
+// and group markers are sent with the chunk that follows them. The end
+// marker is sent in a message with LastMessage set, the cancel marker in a
+// message with Cancel and LastMessage set.
+type TSMsgWriter struct {
+	send    func(m *TSMsg) error
+	buf     []byte
+	pending []byte
+	sent    bool
+	done    bool
+	err     error
+
+	seq    int64    // Sequence number of the last chunk.
+	resume int64    // Sequence number of the last acknowledged chunk.
+	group  [][]byte // Chunks of a group held until its commit, or nil.
+
+	groupBegin []byte
+}
+
+// NewTSMsgWriter returns a writer that calls send for each message.
+func NewTSMsgWriter(send func(m *TSMsg) error) *TSMsgWriter {
+	return &TSMsgWriter{send: send}
+}
+
+// Write writes stream bytes. Messages are sent as chunks are completed.
+func (w *TSMsgWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.done {
+		return 0, errors.New("rpc: write after last message")
+	}
+	w.buf = append(w.buf, p...)
+	at := 0
+	for !w.done {
+		n, frame, err := ts.ScanFrames(w.buf[at:], false)
+		if err != nil {
+			w.err = err
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		at += n
+		if err := w.frame(frame); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	w.buf = append(w.buf[:0], w.buf[at:]...)
+	return len(p), nil
+}
+
+// Resume sets the writer to skip the chunks up to and including sequence
+// number seq, as acknowledged by the receiver of an earlier transfer.
+// Chunks of the control tables are always sent so the receiver can read
+// the chunks that follow. A group is only skipped if all of its chunks
+// are, otherwise all of its chunks are sent.
+// Resume must be called before the first Write.
+func (w *TSMsgWriter) Resume(seq int64) {
+	w.resume = seq
+}
+
+// frame adds a complete frame of the stream.
+func (w *TSMsgWriter) frame(frame []byte) error {
+	switch ts.FrameKind(frame) {
+	default:
+		w.pending = append(w.pending, frame...)
+	case ts.FrameChunk:
+		w.seq++
+		if w.group != nil {
+			w.group = append(w.group, append([]byte(nil), frame...))
+			return nil
+		}
+		return w.chunk(w.seq, frame, w.seq <= w.resume)
+	case ts.FrameGroupBegin:
+		if w.seq < w.resume {
+			// The group may have been acknowledged; hold it until the commit.
+			w.group = [][]byte{}
+			w.groupBegin = append(w.groupBegin[:0], frame...)
+			return nil
+		}
+		w.pending = append(w.pending, frame...)
+	case ts.FrameGroupCommit:
+		if w.group == nil {
+			w.pending = append(w.pending, frame...)
+			return nil
+		}
+		group := w.group
+		w.group = nil
+		skip := w.seq <= w.resume
+		if !skip {
+			w.pending = append(w.pending, w.groupBegin...)
+		}
+		seq := w.seq - int64(len(group))
+		for _, f := range group {
+			seq++
+			if err := w.chunk(seq, f, skip); err != nil {
+				return err
+			}
+		}
+		if !skip {
+			w.pending = append(w.pending, frame...)
+		}
+	case ts.FrameEOF:
+		w.pending = append(w.pending, frame...)
+		return w.flush(0, true, false)
+	case ts.FrameCancel:
+		w.pending = append(w.pending, frame...)
+		return w.flush(0, true, true)
+	}
+	return nil
+}
+
+// chunk sends chunk seq. Unless it is a control chunk it is skipped
+// if skip is set.
+func (w *TSMsgWriter) chunk(seq int64, frame []byte, skip bool) error {
+	if skip && !ts.ControlFrame(frame) {
+		return nil
+	}
+	w.pending = append(w.pending, frame...)
+	return w.flush(seq, false, false)
+}
+
+// flush sends the pending bytes in a message.
+func (w *TSMsgWriter) flush(seq int64, last, cancel bool) error {
+	m := &TSMsg{
+		FirstMessage: !w.sent,
+		LastMessage:  last,
+		Cancel:       cancel,
+		Sequence:     seq,
+		Chunk:        w.pending,
+	}
+	if !w.sent {
+		m.Version = TSVersion
+	}
+	w.sent = true
+	w.done = last
+	w.pending = nil
+	return w.send(m)
+}
+
+// Cancel sends a message with Cancel set, ending the stream.
+// Bytes written after the last complete chunk are discarded.
+func (w *TSMsgWriter) Cancel() error {
+	if w.err != nil || w.done {
+		return w.err
+	}
+	w.buf = nil
+	w.err = w.flush(0, true, true)
+	return w.err
+}
+
+// Close sends the last message if the stream did not end with an end
+// or cancel marker. It is an error if the stream ends within a chunk.
+func (w *TSMsgWriter) Close() error {
+	if w.err != nil || w.done {
+		return w.err
+	}
+	if len(w.buf) > 0 {
+		w.err = errors.New("rpc: stream ends within a chunk")
+		return w.err
+	}
+	w.err = w.flush(0, true, false)
+	return w.err
+}
+
+// TSMsgReader is an io.Reader that puts a ts stream back together from
+// TSMsg frames. After a message with Cancel set, Read returns
+// ts.ErrStreamCancel; after a message with LastMessage set it returns
+// io.EOF.
+type TSMsgReader struct {
+	recv  func() (*TSMsg, error)
+	chunk []byte
+	first bool
+	err   error
+
+	cur int64 // Sequence number of the current message.
+	seq int64 // Highest sequence number read.
+}
+
+// NewTSMsgReader returns a reader that calls recv for each message.
+func NewTSMsgReader(recv func() (*TSMsg, error)) *TSMsgReader {
+	return &TSMsgReader{recv: recv, first: true}
+}
+
+func (r *TSMsgReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		m, err := r.recv()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.err = err
+			continue
+		}
+		if r.first {
+			if !m.FirstMessage {
+				r.err = errors.New("rpc: first message not marked first")
+				continue
+			}
+			if m.Version != TSVersion {
+				r.err = errors.New("rpc: unknown stream version " + m.Version)
+				continue
+			}
+			r.first = false
+		}
+		r.chunk = m.Chunk
+		r.cur = m.Sequence
+		switch {
+		case m.Cancel:
+			r.err = ts.ErrStreamCancel
+		case m.LastMessage:
+			r.err = io.EOF
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	if len(r.chunk) == 0 && r.cur > r.seq {
+		r.seq = r.cur
+	}
+	return n, nil
+}
+
+// Sequence returns the highest sequence number of the chunks read.
+// A ts.Reader reads a chunk before it returns the rows of the chunk.
+// Only acknowledge a chunk once its rows are handled, and a chunk in a
+// group once the group is committed.
+func (r *TSMsgReader) Sequence() int64 {
+	return r.seq
+}
+
+// Ack returns an acknowledgment of the chunks read.
+func (r *TSMsgReader) Ack() *TSAck {
+	return &TSAck{Sequence: r.seq}
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+func TestTSMsg(t *testing.T) {
+	var msgs []*TSMsg
+	mw := NewTSMsgWriter(func(m *TSMsg) error {
+		msgs = append(msgs, m)
+		return nil
+	})
+	raw := &bytes.Buffer{}
+	w := ts.NewWriter(io.MultiWriter(mw, raw))
+	person := w.Define(ts.Table{Name: "person"},
+		ts.Col{Name: "id", Type: ts.Int64, Key: true},
+		ts.Col{Name: "name", Type: ts.String},
+	)
+	w.Insert(person, 1, "Ann")
+	w.Flush()
+	w.Insert(person, 2, "Bob")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) < 3 {
+		t.Fatalf("got %d messages, want at least 3", len(msgs))
+	}
+	if !msgs[0].FirstMessage || msgs[0].Version != TSVersion || !msgs[len(msgs)-1].LastMessage {
+		t.Fatal("first and last messages not marked")
+	}
+
+	recv := func(msgs []*TSMsg) func() (*TSMsg, error) {
+		return func() (*TSMsg, error) {
+			if len(msgs) == 0 {
+				return nil, io.EOF
+			}
+			m := msgs[0]
+			msgs = msgs[1:]
+			return m, nil
+		}
+	}
+	got := &bytes.Buffer{}
+	if _, err := io.Copy(got, NewTSMsgReader(recv(msgs))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), raw.Bytes()) {
+		t.Fatal("stream read from messages differs from stream written")
+	}
+
+	canceled := append(msgs[:len(msgs)-2:len(msgs)-2], &TSMsg{Cancel: true, LastMessage: true})
+	r := ts.NewReader(NewTSMsgReader(recv(canceled)))
+	n := 0
+	for r.Next() {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("got %d rows before cancel, want 1", n)
+	}
+	if err := r.Err(); err != ts.ErrStreamCancel {
+		t.Fatalf("got error %v, want %v", err, ts.ErrStreamCancel)
+	}
+}
+
+func TestTSMsgResume(t *testing.T) {
+	transfer := func(resume int64) []*TSMsg {
+		var msgs []*TSMsg
+		mw := NewTSMsgWriter(func(m *TSMsg) error {
+			msgs = append(msgs, m)
+			return nil
+		})
+		mw.Resume(resume)
+		w := ts.NewWriter(mw)
+		person := w.Define(ts.Table{Name: "person"},
+			ts.Col{Name: "id", Type: ts.Int64, Key: true},
+		)
+		for i := 1; i <= 4; i++ {
+			w.Insert(person, i)
+			w.Flush()
+		}
+		w.BeginGroup()
+		w.Insert(person, 5)
+		w.Flush()
+		w.Insert(person, 6)
+		w.CommitGroup()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+	// read returns the row IDs read and the sequence number read at each row.
+	read := func(msgs []*TSMsg) ([]int64, []int64) {
+		mr := NewTSMsgReader(func() (*TSMsg, error) {
+			if len(msgs) == 0 {
+				return nil, io.EOF
+			}
+			m := msgs[0]
+			msgs = msgs[1:]
+			return m, nil
+		})
+		r := ts.NewReader(mr)
+		var ids, seqs []int64
+		for r.Next() {
+			var id int64
+			if err := r.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+			seqs = append(seqs, mr.Sequence())
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return ids, seqs
+	}
+
+	ids, seqs := read(transfer(0))
+	if !reflect.DeepEqual(ids, []int64{1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("got rows %v", ids)
+	}
+	list := []struct {
+		ack  int64
+		want []int64
+	}{
+		{seqs[1], []int64{3, 4, 5, 6}},
+		{seqs[3], []int64{5, 6}},
+		{seqs[4] - 1, []int64{5, 6}},
+		{seqs[5], nil},
+	}
+	for _, item := range list {
+		got, _ := read(transfer(item.ack))
+		if !reflect.DeepEqual(got, item.want) {
+			t.Errorf("resume after %d got rows %v, want %v", item.ack, got, item.want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Conflict is a delta row that could not be applied.
+type Conflict struct {
+	Table  string
+	Key    Key
+	Kind   RowKind
+	Reason string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s %v %v: %s", c.Table, c.Key, c.Kind, c.Reason)
+}
+
+// ApplyError lists the conflicts found while applying a delta.
+type ApplyError struct {
+	Conflicts []Conflict
+}
+
+func (e *ApplyError) Error() string {
+	ss := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		ss[i] = c.String()
+	}
+	return fmt.Sprintf("ts: %d conflicts applying delta: %s", len(e.Conflicts), strings.Join(ss, "; "))
+}
+
+// memTable holds the rows of a table in memory, indexed by key.
+type memTable struct {
+	def     TableDef
+	links   []string        // Name of the linked table for each column.
+	tags    []string        // Names of the table tags.
+	colTags [][]string      // Names of the tags of each column.
+	key     []int           // Key column indexes.
+	rows    [][]interface{} // A deleted row is nil.
+	idx     map[string]int  // Row index by key.
+}
+
+func newMemTable(def TableDef, links []string) *memTable {
+	mt := &memTable{
+		def:   def,
+		links: links,
+		idx:   make(map[string]int),
+	}
+	for i, c := range def.Columns {
+		if c.Key {
+			mt.key = append(mt.key, i)
+		}
+	}
+	return mt
+}
+
+// keyOf returns the key values of row and a string form for use as a map key.
+func (mt *memTable) keyOf(row []interface{}) (Key, string) {
+	k := make(Key, len(mt.key))
+	for i, ci := range mt.key {
+		k[i] = row[ci]
+	}
+	return k, keyString(k)
+}
+
+// keyString returns a string that is equal for equal key values.
+func keyString(k Key) string {
+	b := &strings.Builder{}
+	for i, v := range k {
+		if i > 0 {
+			b.WriteByte(0)
+		}
+		fmt.Fprintf(b, "%T:%v", v, v)
+	}
+	return b.String()
+}
+
+// memStream holds the tables of a stream in memory, in table ID order.
+type memStream struct {
+	tables []*memTable
+	byName map[string]*memTable
+}
+
+func newMemStream() *memStream {
+	return &memStream{byName: make(map[string]*memTable)}
+}
+
+// table returns the table for def, adding it if needed. It is an error
+// for a table to have different columns than an existing table of the same name.
+//
+// Table and tag IDs are only valid within a single stream, so links
+// and tags are compared and stored by name.
+func (ms *memStream) table(r *Reader, def TableDef) (*memTable, error) {
+	def, tags, colTags, err := namedTags(r, def)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]string, len(def.Columns))
+	for i, c := range def.Columns {
+		if c.Link == 0 {
+			continue
+		}
+		lt, ok := r.table[c.Link]
+		if !ok {
+			return nil, fmt.Errorf("ts: column %s.%s links to unknown table %d", def.Name, c.Name, c.Link)
+		}
+		links[i] = lt.Name
+	}
+	if mt, ok := ms.byName[def.Name]; ok {
+		if !sameColumns(mt.def.Columns, def.Columns) || !reflect.DeepEqual(mt.links, links) || !reflect.DeepEqual(mt.colTags, colTags) {
+			return nil, fmt.Errorf("ts: table %q columns differ", def.Name)
+		}
+		return mt, nil
+	}
+	mt := newMemTable(def, links)
+	mt.tags, mt.colTags = tags, colTags
+	ms.tables = append(ms.tables, mt)
+	ms.byName[def.Name] = mt
+	return mt, nil
+}
+
+// namedTags returns def without tags and the names of the tags of the
+// table and of each column.
+func namedTags(r *Reader, def TableDef) (TableDef, []string, [][]string, error) {
+	names := func(tags Tags) ([]string, error) {
+		var list []string
+		for _, tag := range tags {
+			name := r.TagName(tag)
+			if len(name) == 0 {
+				return nil, fmt.Errorf("ts: unknown tag %d", tag)
+			}
+			list = append(list, name)
+		}
+		return list, nil
+	}
+	tags, err := names(def.Tags)
+	if err != nil {
+		return def, nil, nil, err
+	}
+	def.Tags = nil
+	cols := make([]Col, len(def.Columns))
+	colTags := make([][]string, len(cols))
+	for i, c := range def.Columns {
+		if colTags[i], err = names(c.Tags); err != nil {
+			return def, nil, nil, err
+		}
+		c.Tags = nil
+		cols[i] = c
+	}
+	def.Columns = cols
+	return def, tags, colTags, nil
+}
+
+func sameColumns(a, b []Col) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.Link, y.Link = 0, 0 // Table IDs may differ between streams.
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// readDef returns the definition of the current row's table.
+func readDef(r *Reader) TableDef {
+	return TableDef{
+		ID:      r.rt.ID,
+		Table:   r.Table(),
+		Columns: r.Columns(),
+	}
+}
+
+// apply applies the current row of r to the table. Conflicts are returned.
+func (mt *memTable) apply(r *Reader) (*Conflict, error) {
+	values, err := r.Values()
+	if err != nil {
+		return nil, err
+	}
+	kind := r.Kind()
+	if len(mt.key) == 0 {
+		if kind != RowData {
+			return &Conflict{Table: mt.def.Name, Kind: kind, Reason: "table has no key columns"}, nil
+		}
+		mt.rows = append(mt.rows, values)
+		return nil, nil
+	}
+	k, ks := mt.keyOf(values)
+	at, exists := mt.idx[ks]
+	switch kind {
+	case RowData:
+		if exists {
+			return &Conflict{Table: mt.def.Name, Key: k, Kind: kind, Reason: "duplicate key"}, nil
+		}
+		mt.idx[ks] = len(mt.rows)
+		mt.rows = append(mt.rows, values)
+	case RowUpdate:
+		if !exists {
+			return &Conflict{Table: mt.def.Name, Key: k, Kind: kind, Reason: "key not found"}, nil
+		}
+		row := mt.rows[at]
+		for i, set := range r.Changed() {
+			if set {
+				row[i] = values[i]
+			}
+		}
+	case RowDelete:
+		if !exists {
+			return &Conflict{Table: mt.def.Name, Key: k, Kind: kind, Reason: "key not found"}, nil
+		}
+		mt.rows[at] = nil
+		delete(mt.idx, ks)
+	}
+	return nil, nil
+}
+
+// read reads all the rows of a stream into ms, applying delta rows.
+func (ms *memStream) read(in io.Reader) ([]Conflict, error) {
+	r := NewReader(in)
+	var conflicts []Conflict
+	for r.Next() {
+		mt, err := ms.table(r, readDef(r))
+		if err != nil {
+			return nil, err
+		}
+		c, err := mt.apply(r)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			conflicts = append(conflicts, *c)
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	// Add tables without rows.
+	for _, def := range r.Tables() {
+		if _, err := ms.table(r, def); err != nil {
+			return nil, err
+		}
+	}
+	return conflicts, nil
+}
+
+// define defines the table in w. Links and tags are mapped to the table
+// and tag IDs of w.
+func (mt *memTable) define(w *Writer) (TableRef, error) {
+	cols := make([]Col, len(mt.def.Columns))
+	copy(cols, mt.def.Columns)
+	for i := range cols {
+		cols[i].Tags = w.defineTags(mt.colTags[i])
+		if len(mt.links[i]) == 0 {
+			continue
+		}
+		lt, ok := w.Lookup(mt.links[i])
+		if !ok {
+			return TableRef{}, fmt.Errorf("ts: column %s.%s links to table %q not yet written", mt.def.Name, cols[i].Name, mt.links[i])
+		}
+		cols[i].Link = lt.ID()
+	}
+	t := mt.def.Table
+	t.Tags = w.defineTags(mt.tags)
+	return w.Define(t, cols...), nil
+}
+
+// readSnapshot reads a stream into ms. Conflicting rows are an error.
+func (ms *memStream) readSnapshot(in io.Reader) error {
+	conflicts, err := ms.read(in)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return &ApplyError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// write writes all tables as data rows.
+func (ms *memStream) write(out io.Writer) error {
+	w := NewWriter(out)
+	for _, mt := range ms.tables {
+		tref, err := mt.define(w)
+		if err != nil {
+			return err
+		}
+		for _, row := range mt.rows {
+			if row == nil {
+				continue
+			}
+			w.Insert(tref, row...)
+		}
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Apply reads the snapshot base, applies the insert, update and delete
+// rows of delta by their key columns, and writes the resulting snapshot to out.
+//
+// Tables are matched by name and must have the same columns in both streams.
+// A data row in delta inserts a row. Inserting an existing key, or updating
+// or deleting a missing key, is a conflict. If there are conflicts an
+// *ApplyError listing all of them is returned and nothing is written to out.
+//
+// Both streams are held in memory.
+func Apply(base, delta io.Reader, out io.Writer) error {
+	ms := newMemStream()
+	if err := ms.readSnapshot(base); err != nil {
+		return err
+	}
+	if err := ms.readSnapshot(delta); err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err := ms.write(buf); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(out)
+	return err
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Compatibility classifies a schema change.
+type Compatibility int
+
+const (
+	// Compatible changes can be read by both old and new readers.
+	Compatible Compatibility = iota
+
+	// Backward compatible changes let new readers read old streams.
+	Backward
+
+	// Forward compatible changes let old readers read new streams.
+	Forward
+
+	// Breaking changes are neither backward nor forward compatible.
+	Breaking
+)
+
+func (c Compatibility) String() string {
+	switch c {
+	case Compatible:
+		return "compatible"
+	case Backward:
+		return "backward compatible"
+	case Forward:
+		return "forward compatible"
+	case Breaking:
+		return "breaking"
+	}
+	return fmt.Sprintf("Compatibility(%d)", int(c))
+}
+
+// compatibility returns the classification of a change that new readers
+// can read old streams with if backward is set, and old readers new streams
+// with if forward is set.
+func compatibility(backward, forward bool) Compatibility {
+	switch {
+	case backward && forward:
+		return Compatible
+	case backward:
+		return Backward
+	case forward:
+		return Forward
+	}
+	return Breaking
+}
+
+// and returns the classification of two changes made together.
+func (c Compatibility) and(o Compatibility) Compatibility {
+	back := (c == Compatible || c == Backward) && (o == Compatible || o == Backward)
+	fwd := (c == Compatible || c == Forward) && (o == Compatible || o == Forward)
+	return compatibility(back, fwd)
+}
+
+// SchemaChange is a single change found by CheckCompatibility.
+// Column is empty for a change to the table.
+type SchemaChange struct {
+	Table         string
+	Column        string
+	Compatibility Compatibility
+	Description   string
+}
+
+func (c SchemaChange) String() string {
+	name := c.Table
+	if len(c.Column) > 0 {
+		name += "." + c.Column
+	}
+	return fmt.Sprintf("%s: %s (%v)", name, c.Description, c.Compatibility)
+}
+
+// CompatibilityReport lists the changes between two schemas.
+type CompatibilityReport struct {
+	Changes []SchemaChange
+}
+
+// Compatibility returns the classification of all the changes together.
+func (r *CompatibilityReport) Compatibility() Compatibility {
+	c := Compatible
+	for _, ch := range r.Changes {
+		c = c.and(ch.Compatibility)
+	}
+	return c
+}
+
+// String returns a report with the overall classification followed by
+// one line for each change.
+func (r *CompatibilityReport) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%v: %d changes\n", r.Compatibility(), len(r.Changes))
+	for _, ch := range r.Changes {
+		fmt.Fprintf(b, "\t%v\n", ch)
+	}
+	return b.String()
+}
+
+// CheckCompatibility compares the old and new table definitions, matching
+// tables and columns by name, and classifies each change.
+//
+// Readers are assumed to read with their own columns as in Reader.Expect.
+// A new reader reading an old stream must be able to read the old columns
+// as the new columns, and an old reader reading a new stream the new columns
+// as the old columns. A table that is missing on one side is read as empty.
+// Changes to Key and Link are breaking. Changes to column order, comments
+// and tags are not reported.
+func CheckCompatibility(old, new []TableDef) *CompatibilityReport {
+	r := &CompatibilityReport{}
+	add := func(table, column string, c Compatibility, format string, a ...interface{}) {
+		r.Changes = append(r.Changes, SchemaChange{
+			Table:         table,
+			Column:        column,
+			Compatibility: c,
+			Description:   fmt.Sprintf(format, a...),
+		})
+	}
+	oldName := tableNames(old)
+	newName := tableNames(new)
+	oldByName := make(map[string]*TableDef, len(old))
+	for i := range old {
+		oldByName[old[i].Name] = &old[i]
+	}
+	newByName := make(map[string]*TableDef, len(new))
+	for i := range new {
+		newByName[new[i].Name] = &new[i]
+	}
+
+	for _, ot := range old {
+		if _, ok := newByName[ot.Name]; !ok {
+			add(ot.Name, "", Backward, "table removed")
+		}
+	}
+	for _, nt := range new {
+		ot, ok := oldByName[nt.Name]
+		if !ok {
+			add(nt.Name, "", Forward, "table added")
+			continue
+		}
+		oldCols := make(map[string]*Col, len(ot.Columns))
+		for i := range ot.Columns {
+			oldCols[ot.Columns[i].Name] = &ot.Columns[i]
+		}
+		newCols := make(map[string]bool, len(nt.Columns))
+		for i := range nt.Columns {
+			nc := &nt.Columns[i]
+			newCols[nc.Name] = true
+			oc, ok := oldCols[nc.Name]
+			if !ok {
+				add(nt.Name, nc.Name, compatibility(hasEmptyValue(nc), true), "column added")
+				continue
+			}
+			if c, desc := compareColumns(oc, nc, oldName, newName); len(desc) > 0 {
+				add(nt.Name, nc.Name, c, "%s", strings.Join(desc, ", "))
+			}
+		}
+		for _, oc := range ot.Columns {
+			if !newCols[oc.Name] {
+				add(nt.Name, oc.Name, compatibility(true, hasEmptyValue(&oc)), "column removed")
+			}
+		}
+	}
+	return r
+}
+
+// hasEmptyValue reports whether a column can be read from a stream without it.
+func hasEmptyValue(c *Col) bool {
+	return c.Nullable || c.Default != nil
+}
+
+// tableNames returns the table names by table ID.
+func tableNames(defs []TableDef) map[int64]string {
+	names := make(map[int64]string, len(defs))
+	for _, d := range defs {
+		names[d.ID] = d.Name
+	}
+	return names
+}
+
+// linkName returns the name of the table linked by ID link, or an empty
+// string if the column is not a link. The ID of a TableDef not read from
+// a stream may be zero, so a zero link is not looked up.
+func linkName(names map[int64]string, link int64) string {
+	if link == 0 {
+		return ""
+	}
+	return names[link]
+}
+
+// compareColumns returns the classification and descriptions of the
+// differences between the old and new column.
+func compareColumns(oc, nc *Col, oldName, newName map[int64]string) (Compatibility, []string) {
+	var desc []string
+	c := Compatible
+	if oc.Type != nc.Type {
+		desc = append(desc, fmt.Sprintf("type changed from %v to %v", oc.Type, nc.Type))
+	}
+	if oc.Length != nc.Length {
+		desc = append(desc, fmt.Sprintf("length changed from %d to %d", oc.Length, nc.Length))
+	}
+	if oc.Nullable != nc.Nullable {
+		desc = append(desc, fmt.Sprintf("nullable changed from %t to %t", oc.Nullable, nc.Nullable))
+	}
+	if !reflect.DeepEqual(oc.Default, nc.Default) {
+		desc = append(desc, fmt.Sprintf("default changed from %v to %v", oc.Default, nc.Default))
+	}
+	if len(desc) > 0 {
+		_, errBack := widen(oc, nc)
+		_, errFwd := widen(nc, oc)
+		c = compatibility(errBack == nil, errFwd == nil)
+	}
+	if oc.Key != nc.Key {
+		desc = append(desc, fmt.Sprintf("key changed from %t to %t", oc.Key, nc.Key))
+		c = Breaking
+	}
+	if ol, nl := linkName(oldName, oc.Link), linkName(newName, nc.Link); ol != nl {
+		desc = append(desc, fmt.Sprintf("link changed from %q to %q", ol, nl))
+		c = Breaking
+	}
+	return c, desc
+}
@@ -0,0 +1,248 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// CSVError is an error in a CSV record read by FromCSV.
+type CSVError struct {
+	Line   int    // Line of the record, the header is line 1.
+	Column string // Column name, empty if the error is not for a column.
+	Err    error
+}
+
+func (e *CSVError) Error() string {
+	if len(e.Column) == 0 {
+		return fmt.Sprintf("ts: csv line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("ts: csv line %d column %q: %v", e.Line, e.Column, e.Err)
+}
+
+// FromCSV defines table t with cols in w and inserts a row for each CSV
+// record read from in. The first record is a header with the names of the
+// columns in the records; columns not in the header are left empty.
+//
+// Int64 and Bool values are parsed with strconv, Bytes values are base64
+// and Hash values are hex. An empty field is left empty, except for a
+// String column that is not nullable and has no default, which is set to
+// the empty string. The links and tags of cols refer to the tables and tags
+// defined in w. An error in a record is returned as a *CSVError.
+// Lines are counted by record, so a quoted field with a new line counts as
+// a single line.
+func FromCSV(w *Writer, in io.Reader, t Table, cols ...Col) (TableRef, error) {
+	tref := w.Define(t, cols...)
+	if err := w.Error(); err != nil {
+		return tref, err
+	}
+	cr := csv.NewReader(in)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return tref, &CSVError{Line: 1, Err: fmt.Errorf("missing header")}
+	}
+	if err != nil {
+		return tref, err
+	}
+	byName := make(map[string]*Col, len(cols))
+	for i := range cols {
+		byName[cols[i].Name] = &cols[i]
+	}
+	header = append([]string(nil), header...)
+	hcols := make([]*Col, len(header))
+	for i, name := range header {
+		c, ok := byName[name]
+		if !ok {
+			return tref, &CSVError{Line: 1, Column: name, Err: fmt.Errorf("not a column of table %q", t.Name)}
+		}
+		hcols[i] = c
+	}
+	use := tref.Use(header...)
+
+	line := 1
+	values := make([]interface{}, len(header))
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return tref, nil
+		}
+		line++
+		if err != nil {
+			return tref, &CSVError{Line: line, Err: err}
+		}
+		for i, field := range record {
+			v, err := parseCSV(hcols[i], field)
+			if err != nil {
+				return tref, &CSVError{Line: line, Column: hcols[i].Name, Err: err}
+			}
+			values[i] = v
+		}
+		w.Insert(use, values...)
+		if err := w.Error(); err != nil {
+			return tref, &CSVError{Line: line, Err: err}
+		}
+	}
+}
+
+// parseCSV returns the value of a CSV field for column c.
+func parseCSV(c *Col, field string) (interface{}, error) {
+	if len(field) == 0 {
+		if c.Type == String && !c.Nullable && c.Default == nil {
+			return "", nil
+		}
+		if !c.Nullable && c.Default == nil {
+			return nil, fmt.Errorf("empty value for a column that is not nullable")
+		}
+		return nil, nil
+	}
+	switch c.Type {
+	case Int64:
+		return strconv.ParseInt(field, 10, 64)
+	case Bool:
+		return strconv.ParseBool(field)
+	case String, Any:
+		return field, nil
+	case Bytes:
+		return base64.StdEncoding.DecodeString(field)
+	case Hash:
+		b, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, err
+		}
+		var h [32]byte
+		if len(b) != len(h) {
+			return nil, fmt.Errorf("hash has %d bytes, want %d", len(b), len(h))
+		}
+		copy(h[:], b)
+		return h, nil
+	}
+	return nil, fmt.Errorf("unknown type %v", c.Type)
+}
+
+// CSVOptions controls how ToCSV writes a table.
+type CSVOptions struct {
+	// Hidden includes columns tagged TagHidden.
+	Hidden bool
+}
+
+// ToCSV writes the data rows of the named table read from in as CSV to
+// out, starting with a header of column names. Columns tagged TagHidden
+// are left out unless opt.Hidden is set. Values are formatted as FromCSV
+// reads them, and null values are written as empty fields.
+// It is an error if the table has update or delete rows, or if the table is
+// redefined in the stream with other columns after rows are written.
+func ToCSV(out io.Writer, in io.Reader, table string, opt CSVOptions) error {
+	r := NewReader(in)
+	cw := csv.NewWriter(out)
+	names := func(cols []Col) []string {
+		list := []string{}
+		for _, c := range cols {
+			if !opt.Hidden && hasTag(c.Tags, TagHidden) {
+				continue
+			}
+			list = append(list, c.Name)
+		}
+		return list
+	}
+	var header []string
+	var version [32]byte
+	var record []string
+	for r.Next() {
+		if r.Table().Name != table {
+			continue
+		}
+		cols := r.Columns()
+		switch {
+		case header == nil:
+			header = names(cols)
+			version = r.Version()
+			if err := cw.Write(header); err != nil {
+				return err
+			}
+		case r.Version() != version:
+			if !sameNames(names(cols), header) {
+				return fmt.Errorf("ts: columns of table %q change in the stream", table)
+			}
+			version = r.Version()
+		}
+		if kind := r.Kind(); kind != RowData {
+			return fmt.Errorf("ts: cannot write %v rows of table %q as CSV", kind, table)
+		}
+		values, err := r.Values()
+		if err != nil {
+			return err
+		}
+		record = record[:0]
+		for _, name := range header {
+			var v interface{}
+			for i, c := range cols {
+				if c.Name == name {
+					v = values[i]
+					break
+				}
+			}
+			record = append(record, formatCSV(v))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if header == nil {
+		found := false
+		for _, def := range r.Tables() {
+			if def.Name == table {
+				found = true
+				if err := cw.Write(names(def.Columns)); err != nil {
+					return err
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("ts: table %q not in stream", table)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sameNames reports whether a and b hold the same names in the same order.
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatCSV returns the CSV field for value v.
+func formatCSV(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case bool:
+		return strconv.FormatBool(x)
+	case string:
+		return x
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x)
+	case [32]byte:
+		return hex.EncodeToString(x[:])
+	}
+	return fmt.Sprint(v)
+}
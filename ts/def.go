@@ -6,6 +6,7 @@ package ts
 
 import (
 	"errors"
+	"fmt"
 )
 
 var ErrStreamCancel = errors.New("ts: stream cancel")
@@ -51,6 +52,15 @@ const (
 	Any    Type = 6
 )
 
+func (t Type) String() string {
+	for _, ft := range builtinFieldTypes {
+		if ft.Type == t {
+			return ft.Name
+		}
+	}
+	return fmt.Sprintf("Type(%d)", int64(t))
+}
+
 type Tag int64
 
 type Tags []Tag
@@ -0,0 +1,204 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+)
+
+// RowKind is the type of a row, recorded in the chunk row-offset list.
+type RowKind byte
+
+const (
+	// RowData is a row of table data. In a delta stream a data row
+	// inserts a new row.
+	RowData RowKind = 'R'
+
+	// RowUpdate sets the listed columns of the row with the given key.
+	RowUpdate RowKind = 'U'
+
+	// RowDelete removes the row with the given key.
+	RowDelete RowKind = 'D'
+)
+
+func (k RowKind) String() string {
+	switch k {
+	case RowData:
+		return "data"
+	case RowUpdate:
+		return "update"
+	case RowDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("RowKind(%q)", byte(k))
+}
+
+// Key holds the values of a composite key, one value for each
+// key column in column order.
+type Key []interface{}
+
+// keyColumns returns the names of the key columns of the table.
+func (ti *tableInfo) keyColumns() []string {
+	var names []string
+	for _, c := range ti.Columns {
+		if c.Key {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// keyValues returns the key column names and the values for key.
+// A single key column takes the value directly, multiple key columns take a Key.
+func (ti *tableInfo) keyValues(key interface{}) ([]string, []interface{}, error) {
+	names := ti.keyColumns()
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("ts: table %q has no key columns", ti.Name)
+	}
+	values, ok := key.(Key)
+	if !ok {
+		values = Key{key}
+	}
+	if len(values) != len(names) {
+		return nil, nil, fmt.Errorf("ts: table %q has %d key columns, got %d key values", ti.Name, len(names), len(values))
+	}
+	for i, v := range values {
+		if v == nil {
+			return nil, nil, fmt.Errorf("ts: null key value for %s.%s", ti.Name, names[i])
+		}
+	}
+	return names, values, nil
+}
+
+// Update writes an update row that sets the columns selected in t
+// to values, for the row with the given key. Columns not selected are
+// unchanged. A nil value sets a Nullable column to null.
+//
+// Use TableRef.Use to select the changed columns. Key columns cannot
+// be changed. For a table with multiple key columns, key must be a Key.
+func (w *Writer) Update(t TableRef, key interface{}, values ...interface{}) RowRef {
+	if w.err != nil {
+		return errRow
+	}
+	ti := w.writeTable(t)
+	if ti == nil {
+		return errRow
+	}
+	if len(t.col) != len(values) {
+		w.err = fmt.Errorf("ts: expected %d values, got %d values", len(t.col), len(values))
+		return errRow
+	}
+	names, kv, err := ti.keyValues(key)
+	if err != nil {
+		w.err = err
+		return errRow
+	}
+	for _, name := range t.col {
+		if c := ti.ColumnByName[name]; c != nil && c.Key {
+			w.err = fmt.Errorf("ts: cannot update key column %s.%s", ti.Name, name)
+			return errRow
+		}
+	}
+	names = append(names, t.col...)
+	kv = append(kv, values...)
+	return w.writeRow(ti, RowUpdate, names, kv)
+}
+
+// Delete writes a delete row for the row with the given key.
+// For a table with multiple key columns, key must be a Key.
+func (w *Writer) Delete(t TableRef, key interface{}) RowRef {
+	if w.err != nil {
+		return errRow
+	}
+	ti := w.writeTable(t)
+	if ti == nil {
+		return errRow
+	}
+	names, kv, err := ti.keyValues(key)
+	if err != nil {
+		w.err = err
+		return errRow
+	}
+	return w.writeRow(ti, RowDelete, names, kv)
+}
+
+func (w *Writer) writeRow(ti *tableInfo, kind RowKind, names []string, values []interface{}) RowRef {
+	values, err := w.resolveRefs(ti, names, values)
+	if err != nil {
+		w.err = err
+		return errRow
+	}
+	if err := w.checkRow(ti, kind, names, values); err != nil {
+		w.err = err
+		return errRow
+	}
+	if w.parallel > 1 {
+		w.deferRow(ti, kind, names, values)
+		return w.rowRef(ti, kind, names, values)
+	}
+	rowdata, err := w.encodeRow(&w.rowBuilder, ti, kind, names, values)
+	if err != nil {
+		w.err = err
+		return errRow
+	}
+	w.rowBuffer[ti.ID] = append(w.rowBuffer[ti.ID], rowdata)
+	return w.rowRef(ti, kind, names, values)
+}
+
+// Kind returns the kind of the current row.
+func (r *Reader) Kind() RowKind {
+	if r.rt == nil || r.rowIndex < 0 {
+		return 0
+	}
+	return RowKind(r.rows[r.rowIndex].Type)
+}
+
+// Changed reports for each column whether the current row sets it.
+// All columns of a data row are set. An update row sets the key columns
+// and the changed columns, a delete row only sets the key columns.
+func (r *Reader) Changed() []bool {
+	if r.rt == nil {
+		return nil
+	}
+	kind := r.Kind()
+	return r.rt.viewChanged(rowChanged(r.row, len(r.rt.columns)), kind)
+}
+
+// rowChanged reports for each of the ncol columns whether row sets it.
+func rowChanged(row []byte, ncol int) []bool {
+	set := make([]bool, ncol)
+	maskLen := (ncol + 7) / 8
+	if len(row) < 2+maskLen || RowKind(row[1]) == RowData {
+		for i := range set {
+			set[i] = true
+		}
+		return set
+	}
+	kind := RowKind(row[1])
+	mask := row[2 : 2+maskLen]
+	var nullMask []byte
+	if kind == RowUpdate && len(row) >= 2+2*maskLen {
+		nullMask = row[2+maskLen : 2+2*maskLen]
+	}
+	for i := range set {
+		bit := byte(1 << uint(i%8))
+		set[i] = mask[i/8]&bit != 0 || (nullMask != nil && nullMask[i/8]&bit != 0)
+	}
+	return set
+}
+
+// Kind returns the kind of the current row.
+func (c *Cursor) Kind() RowKind {
+	return c.r.Kind()
+}
+
+// isRowKind reports whether rows of kind b are returned from a Reader.
+func isRowKind(b byte) bool {
+	switch RowKind(b) {
+	case RowData, RowUpdate, RowDelete:
+		return true
+	}
+	return false
+}
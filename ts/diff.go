@@ -0,0 +1,203 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// SchemaDiff is a difference between the table definitions of two streams.
+// Column is empty if the difference is not for a single column.
+type SchemaDiff struct {
+	Table  string
+	Column string
+	Reason string
+}
+
+func (d SchemaDiff) String() string {
+	if len(d.Column) == 0 {
+		return fmt.Sprintf("%s: %s", d.Table, d.Reason)
+	}
+	return fmt.Sprintf("%s.%s: %s", d.Table, d.Column, d.Reason)
+}
+
+// SchemaError lists the schema differences found by Diff.
+type SchemaError struct {
+	Diffs []SchemaDiff
+}
+
+func (e *SchemaError) Error() string {
+	ss := make([]string, len(e.Diffs))
+	for i, d := range e.Diffs {
+		ss[i] = d.String()
+	}
+	return fmt.Sprintf("ts: %d schema differences: %s", len(e.Diffs), strings.Join(ss, "; "))
+}
+
+// schemaDiffs returns the differences between the definitions of a and b.
+func schemaDiffs(a, b *memTable) []SchemaDiff {
+	var diffs []SchemaDiff
+	add := func(column, reason string) {
+		diffs = append(diffs, SchemaDiff{Table: a.def.Name, Column: column, Reason: reason})
+	}
+	bcol := make(map[string]int, len(b.def.Columns))
+	for i, c := range b.def.Columns {
+		bcol[c.Name] = i
+	}
+	for i, x := range a.def.Columns {
+		j, ok := bcol[x.Name]
+		if !ok {
+			add(x.Name, "column removed")
+			continue
+		}
+		delete(bcol, x.Name)
+		switch {
+		case i != j:
+			add(x.Name, fmt.Sprintf("column moved from %d to %d", i, j))
+		case a.links[i] != b.links[j]:
+			add(x.Name, fmt.Sprintf("link changed from %q to %q", a.links[i], b.links[j]))
+		case !sameColumns(a.def.Columns[i:i+1], b.def.Columns[j:j+1]) || !reflect.DeepEqual(a.colTags[i], b.colTags[j]):
+			add(x.Name, "column definition changed")
+		}
+	}
+	for _, c := range b.def.Columns {
+		if _, ok := bcol[c.Name]; ok {
+			add(c.Name, "column added")
+		}
+	}
+	if len(diffs) == 0 && (!reflect.DeepEqual(a.def.Table, b.def.Table) || !reflect.DeepEqual(a.tags, b.tags)) {
+		add("", "table definition changed")
+	}
+	return diffs
+}
+
+// Diff reads the snapshots old and new and writes to out the insert,
+// update and delete rows that change old into new.
+// Rows are matched by their key columns and an update row only sets
+// the columns that changed. Applying the result to old with Apply gives new.
+//
+// Tables are matched by name. Only tables with the same definition in
+// both streams are compared. Tables that were added, removed or changed,
+// and tables without key columns whose rows differ, are not written and
+// are returned in a *SchemaError after the delta is written.
+//
+// Both streams are held in memory.
+func Diff(old, new io.Reader, out io.Writer) error {
+	a := newMemStream()
+	if err := a.readSnapshot(old); err != nil {
+		return err
+	}
+	b := newMemStream()
+	if err := b.readSnapshot(new); err != nil {
+		return err
+	}
+
+	var diffs []SchemaDiff
+	for _, mt := range a.tables {
+		if _, ok := b.byName[mt.def.Name]; !ok {
+			diffs = append(diffs, SchemaDiff{Table: mt.def.Name, Reason: "table removed"})
+		}
+	}
+	w := NewWriter(out)
+	same := make(map[string]bool, len(b.tables))
+	for _, nt := range b.tables {
+		ot, ok := a.byName[nt.def.Name]
+		if !ok {
+			diffs = append(diffs, SchemaDiff{Table: nt.def.Name, Reason: "table added"})
+			continue
+		}
+		if d := schemaDiffs(ot, nt); len(d) > 0 {
+			diffs = append(diffs, d...)
+			continue
+		}
+		linked := true
+		for i, link := range nt.links {
+			if len(link) > 0 && !same[link] {
+				diffs = append(diffs, SchemaDiff{Table: nt.def.Name, Column: nt.def.Columns[i].Name, Reason: fmt.Sprintf("linked table %q differs", link)})
+				linked = false
+			}
+		}
+		if !linked {
+			continue
+		}
+		if len(nt.key) == 0 {
+			if !reflect.DeepEqual(ot.live(), nt.live()) {
+				diffs = append(diffs, SchemaDiff{Table: nt.def.Name, Reason: "rows differ in table without key columns"})
+				continue
+			}
+		}
+		same[nt.def.Name] = true
+		tref, err := nt.define(w)
+		if err != nil {
+			return err
+		}
+		if len(nt.key) > 0 {
+			diffRows(w, tref, ot, nt)
+		}
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return &SchemaError{Diffs: diffs}
+	}
+	return nil
+}
+
+// diffRows writes the rows that change the rows of a into the rows of b.
+// Deletes are written first, in the order of a, followed by updates
+// and inserts in the order of b.
+func diffRows(w *Writer, t TableRef, a, b *memTable) {
+	for _, row := range a.rows {
+		if row == nil {
+			continue
+		}
+		k, ks := a.keyOf(row)
+		if _, ok := b.idx[ks]; !ok {
+			w.Delete(t, k)
+		}
+	}
+	for _, row := range b.rows {
+		if row == nil {
+			continue
+		}
+		k, ks := b.keyOf(row)
+		at, ok := a.idx[ks]
+		if !ok {
+			w.Insert(t, row...)
+			continue
+		}
+		prev := a.rows[at]
+		var names []string
+		var values []interface{}
+		for i, c := range b.def.Columns {
+			if c.Key || reflect.DeepEqual(prev[i], row[i]) {
+				continue
+			}
+			names = append(names, c.Name)
+			values = append(values, row[i])
+		}
+		if len(names) > 0 {
+			w.Update(t.Use(names...), k, values...)
+		}
+	}
+}
+
+// live returns the rows that are not deleted.
+func (mt *memTable) live() [][]interface{} {
+	rows := make([][]interface{}, 0, len(mt.rows))
+	for _, row := range mt.rows {
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
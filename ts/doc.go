@@ -119,17 +119,37 @@ The data for the schemas are written first, followed by the data for all other t
 	 * Data Row
 	 * Field Value
 	 * Delta (insert/update/delete)
-	 * Validation
-	 * ? Error code + Error message ?
+	 * Validation (row ID, column, error code and error message)
 	 * Reference Data Row
 
 	CHUNK = FS "C" <chunk-length> (begin-chunk) <table-id><row-count><row-offset-list><row-data> (end-chunk)
 		<row-offset-list> = [N]<row-type><row-offset-from-chunk-start>[/N]
 
-		ROW = RS "R" <row-data>
-			variable length field = <value-size-bytes><value-id><value-data>
+		ROW = RS "R" <value-bitmask> <row-data>
+			<value-bitmask> = one bit per column, set if the column has a value
+			fixed length field = <value-data> (fixed_bit_size rounded up to bytes)
+			variable length field = <value-size-bytes><value-data>
+		UPDATE = RS "U" <value-bitmask> <null-bitmask> <row-data>
+			key columns and changed columns have values, <null-bitmask> marks columns set to null
+		DELETE = RS "D" <value-bitmask> <row-data>
+			only the key columns have values
+		VALIDATION = RS "V" <row-id> <column-size><column> <code> <message-size><message>
+			row-id is the position of the row in the table starting at one, zero for the table
+			column is the column name, empty for the row
+		VERSION = RS "H" <version-hash>
+			first row of each chunk of a table that was redefined, the version
+			of control/table the rows were written with
 		VALUE = RS "F" <value-id><value-offset-bytes><value-data>
 
+	GROUP = GS "B" {CHUNK}... GS "C"
+		The chunks of a group are applied as a whole. A reader discards
+		a group that is not committed before CANCEL.
+
+	INDEX = FS "I" <index-length> <entry-count> [N]<table-id><chunk-offset><key-size><key-row>[/N] <index-offset>
+		chunk-offset is the offset of the chunk from the stream start,
+		key-row is a ROW with the key columns of the first row of the chunk,
+		empty for control tables. index-offset is the offset of the INDEX.
+
 	CANCEL = FS CAN
 	EOF = FS EOT
 
@@ -146,6 +166,12 @@ The data for the schemas are written first, followed by the data for all other t
 			{/Chunk}
 		[/N chunks]
 	[/for each schema data table]
+	[optional, around any chunks]
+		{GROUP}
+	[/optional]
+	[optional]
+		{INDEX}
+	[/optional]
 	[optional]
 		{CANCEL}
 	[/optional]
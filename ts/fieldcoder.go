@@ -18,7 +18,39 @@ type FieldCoder interface {
 	// Values smaller then 8 bits may be OR'ed to gether with the previous value.
 	Encode(col *Col, writeTo []byte, value interface{}) ([]byte, error)
 
-	// TODO(kardianos): write decoder interface along with reeading / scanning table interface.
+	// Decode returns the value encoded in data. For fixed length fields data
+	// is exactly the fixed size in bytes. Decode must not retain data.
+	Decode(col *Col, data []byte) (interface{}, error)
+}
+
+// fixedByteSize returns the number of bytes a fixed length field uses in a row.
+// Variable length fields return zero.
+func fixedByteSize(bitSize int64) int64 {
+	return (bitSize + 7) / 8
+}
+
+type fieldType struct {
+	Type  Type
+	Name  string
+	Coder FieldCoder
+}
+
+var builtinFieldTypes = []fieldType{
+	{Hash, "hash", coderHash{}},
+	{Int64, "int64", coderInt64{}},
+	{Bool, "bool", coderBool{}},
+	{String, "string", coderString{}},
+	{Bytes, "bytes", coderBytes{}},
+	{Any, "any", coderAny{}},
+}
+
+func builtinFieldCoder(t Type) (FieldCoder, bool) {
+	for _, ft := range builtinFieldTypes {
+		if ft.Type == t {
+			return ft.Coder, true
+		}
+	}
+	return nil, false
 }
 
 const hashSizeBits = 256
@@ -35,16 +67,30 @@ func (coderHash) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, er
 	} else {
 		writeTo = writeTo[:hashSizeBytes]
 	}
+	for i := range writeTo {
+		writeTo[i] = 0
+	}
 	switch v := value.(type) {
 	default:
 		return writeTo, fmt.Errorf("ts: unknown value type %#v", value)
+	case zero:
 	case []byte:
 		copy(writeTo, v)
 	case [8]byte:
 		copy(writeTo, v[:])
+	case [hashSizeBytes]byte:
+		copy(writeTo, v[:])
 	}
 	return writeTo, nil
 }
+func (coderHash) Decode(col *Col, data []byte) (interface{}, error) {
+	var v [hashSizeBytes]byte
+	if len(data) != hashSizeBytes {
+		return v, fmt.Errorf("ts: hash for %q has %d bytes, expected %d", col.Name, len(data), hashSizeBytes)
+	}
+	copy(v[:], data)
+	return v, nil
+}
 
 type coderInt64 struct{}
 
@@ -60,13 +106,25 @@ func (coderInt64) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, e
 	switch v := value.(type) {
 	default:
 		return writeTo, fmt.Errorf("ts: unknown value type %#v", value)
+	case zero:
+		binary.LittleEndian.PutUint64(writeTo, 0)
 	case int64:
 		binary.LittleEndian.PutUint64(writeTo, uint64(v))
 	case int:
 		binary.LittleEndian.PutUint64(writeTo, uint64(v))
+	case Type:
+		binary.LittleEndian.PutUint64(writeTo, uint64(v))
+	case Tag:
+		binary.LittleEndian.PutUint64(writeTo, uint64(v))
 	}
 	return writeTo, nil
 }
+func (coderInt64) Decode(col *Col, data []byte) (interface{}, error) {
+	if len(data) != 8 {
+		return int64(0), fmt.Errorf("ts: int64 for %q has %d bytes, expected 8", col.Name, len(data))
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
 
 type coderBool struct{}
 
@@ -82,6 +140,8 @@ func (coderBool) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, er
 	switch v := value.(type) {
 	default:
 		return writeTo, fmt.Errorf("ts: unknown value type %#v", value)
+	case zero:
+		writeTo[0] = 0
 	case bool:
 		if v {
 			writeTo[0] = 1
@@ -91,6 +151,12 @@ func (coderBool) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, er
 	}
 	return writeTo, nil
 }
+func (coderBool) Decode(col *Col, data []byte) (interface{}, error) {
+	if len(data) != 1 {
+		return false, fmt.Errorf("ts: bool for %q has %d bytes, expected 1", col.Name, len(data))
+	}
+	return data[0] != 0, nil
+}
 
 type coderString struct{}
 
@@ -98,42 +164,43 @@ func (coderString) BitSize() int64 {
 	return 0
 }
 func (coderString) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, error) {
-	var runeCount int64
-	switch v := value.(type) {
+	var v string
+	switch x := value.(type) {
 	default:
 		return writeTo, fmt.Errorf("ts: unknown value type %#v", value)
+	case zero:
+		return writeTo[:0], nil
 	case string:
-		if cap(writeTo) < len(v) {
-			writeTo = make([]byte, len(v))
-		}
-		writeTo = writeTo[:len(v)]
-		for i, r := range v {
-			if r == utf8.RuneError {
-				return nil, fmt.Errorf("ts: invalid utf8 string, invalid rune at byte index %d", i)
-			}
-			runeCount++
-			utf8.EncodeRune(writeTo[i:], r)
-		}
+		v = x
 	case []byte:
-		if cap(writeTo) < len(v) {
-			writeTo = make([]byte, len(v))
-		}
-		writeTo = writeTo[:len(v)]
-		i := 0
-		for {
-			r, sz := utf8.DecodeRune(v[i:])
-			if r == utf8.RuneError {
-				return nil, fmt.Errorf("ts: invalid utf8 string, invalid rune at byte index %d", i)
-			}
-			runeCount++
-			utf8.EncodeRune(writeTo[i:], r)
-			i += sz
+		v = string(x)
+	}
+	if err := checkString(col, v); err != nil {
+		return nil, err
+	}
+	return append(writeTo[:0], v...), nil
+}
+
+// checkString checks that v holds no invalid or replacement runes and, if
+// col has a length, at most that many runes.
+func checkString(col *Col, v string) error {
+	var runeCount int64
+	for i, r := range v {
+		if r == utf8.RuneError {
+			return fmt.Errorf("ts: invalid utf8 string, invalid rune at byte index %d", i)
 		}
+		runeCount++
 	}
 	if col.Length > 0 && runeCount > col.Length {
-		return nil, fmt.Errorf("ts: value for %q contains %d runes, max allowed is %d", col.Name, runeCount, col.Length)
+		return fmt.Errorf("ts: value for %q contains %d runes, max allowed is %d", col.Name, runeCount, col.Length)
 	}
-	return writeTo, nil
+	return nil
+}
+func (coderString) Decode(col *Col, data []byte) (interface{}, error) {
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("ts: invalid utf8 string for %q", col.Name)
+	}
+	return string(data), nil
 }
 
 type coderBytes struct{}
@@ -145,29 +212,86 @@ func (coderBytes) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, e
 	switch v := value.(type) {
 	default:
 		return writeTo, fmt.Errorf("ts: unknown value type %#v", value)
+	case zero:
+		writeTo = writeTo[:0]
 	case string:
 		if cap(writeTo) < len(v) {
-			writeTo = []byte(v)
-		} else {
-			n := copy(writeTo, []byte(v))
-			writeTo = writeTo[:n]
+			writeTo = make([]byte, len(v))
 		}
+		writeTo = writeTo[:len(v)]
+		copy(writeTo, v)
 	case []byte:
 		if cap(writeTo) < len(v) {
 			writeTo = make([]byte, len(v))
 		}
 		writeTo = writeTo[:len(v)]
-		n := copy(writeTo, v)
-		writeTo = writeTo[:n]
+		copy(writeTo, v)
+	}
+	if col.Length > 0 && int64(len(writeTo)) > col.Length {
+		return nil, fmt.Errorf("ts: value for %q contains %d bytes, max allowed is %d", col.Name, len(writeTo), col.Length)
 	}
 	return writeTo, nil
 }
+func (coderBytes) Decode(col *Col, data []byte) (interface{}, error) {
+	v := make([]byte, len(data))
+	copy(v, data)
+	return v, nil
+}
 
+// coderAny encodes a type prefix followed by the value encoded with the
+// coder of that type. A type prefix of zero encodes Zero.
 type coderAny struct{}
 
 func (coderAny) BitSize() int64 {
 	return 0
 }
+
+// anyType returns the field type used to encode value in an Any field.
+func anyType(value interface{}) (Type, bool) {
+	switch value.(type) {
+	case zero:
+		return 0, true
+	case [hashSizeBytes]byte:
+		return Hash, true
+	case int64, int, Type, Tag:
+		return Int64, true
+	case bool:
+		return Bool, true
+	case string:
+		return String, true
+	case []byte:
+		return Bytes, true
+	}
+	return 0, false
+}
+
 func (coderAny) Encode(col *Col, writeTo []byte, value interface{}) ([]byte, error) {
-	return writeTo[:0], nil
+	ft, ok := anyType(value)
+	if !ok {
+		return writeTo, fmt.Errorf("ts: unknown value type %#v", value)
+	}
+	writeTo = append(writeTo[:0], byte(ft))
+	if ft == 0 {
+		return writeTo, nil
+	}
+	fc, _ := builtinFieldCoder(ft)
+	inner, err := fc.Encode(col, nil, value)
+	if err != nil {
+		return nil, err
+	}
+	return append(writeTo, inner...), nil
+}
+func (coderAny) Decode(col *Col, data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("ts: missing type for any value %q", col.Name)
+	}
+	ft := Type(data[0])
+	if ft == 0 {
+		return Zero, nil
+	}
+	fc, ok := builtinFieldCoder(ft)
+	if !ok || ft == Any {
+		return nil, fmt.Errorf("ts: invalid type %d for any value %q", ft, col.Name)
+	}
+	return fc.Decode(col, data[1:])
 }
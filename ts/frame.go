@@ -0,0 +1,103 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Frame is the kind of a frame returned by ScanFrames.
+type Frame byte
+
+const (
+	FrameHeader      Frame = 'H' // The stream header.
+	FrameChunk       Frame = 'C' // A chunk of rows.
+	FrameGroupBegin  Frame = 'B' // The start of a group.
+	FrameGroupCommit Frame = 'M' // The commit of a group.
+	FrameEOF         Frame = 'E' // The end of the stream.
+	FrameCancel      Frame = 'X' // A canceled stream.
+	FrameIndex       Frame = 'I' // The key index.
+)
+
+// FrameKind returns the kind of a frame returned by ScanFrames.
+func FrameKind(frame []byte) Frame {
+	switch {
+	case bytes.HasPrefix(frame, fileHeader):
+		return FrameHeader
+	case bytes.HasPrefix(frame, markerChunk):
+		return FrameChunk
+	case bytes.HasPrefix(frame, markerIndex):
+		return FrameIndex
+	case bytes.Equal(frame, markerGroupBegin):
+		return FrameGroupBegin
+	case bytes.Equal(frame, markerGroupCommit):
+		return FrameGroupCommit
+	case bytes.Equal(frame, fileEOF):
+		return FrameEOF
+	case bytes.Equal(frame, fileCancel):
+		return FrameCancel
+	}
+	return 0
+}
+
+// ScanFrames is a bufio.SplitFunc that splits a stream into frames:
+// the header, each chunk, group markers, the key index and the end or
+// cancel marker.
+// Concatenating the frames gives the stream back.
+func ScanFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	n := 2
+	if data[0] == fileHeader[0] {
+		n = len(fileHeader)
+	}
+	if len(data) < n {
+		return needMore(data, atEOF)
+	}
+	frame := data[:n]
+	switch {
+	default:
+		return 0, nil, fmt.Errorf("ts: unknown marker %v", frame)
+	case bytes.Equal(frame, fileHeader),
+		bytes.Equal(frame, markerGroupBegin),
+		bytes.Equal(frame, markerGroupCommit),
+		bytes.Equal(frame, fileEOF),
+		bytes.Equal(frame, fileCancel):
+		return n, frame, nil
+	case bytes.Equal(frame, markerChunk), bytes.Equal(frame, markerIndex):
+	}
+	if len(data) < 10 {
+		return needMore(data, atEOF)
+	}
+	size := int64(binary.LittleEndian.Uint64(data[2:]))
+	if size < 16 {
+		return 0, nil, fmt.Errorf("ts: invalid frame size %d", size)
+	}
+	if int64(len(data)-10) < size {
+		return needMore(data, atEOF)
+	}
+	n = 10 + int(size)
+	return n, data[:n], nil
+}
+
+func needMore(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF {
+		return 0, nil, fmt.Errorf("ts: stream ends in a frame")
+	}
+	return 0, nil, nil
+}
+
+// ControlFrame reports whether frame is a chunk of a control table.
+// Control chunks carry the schema, so a reader needs them to read the
+// chunks that follow.
+func ControlFrame(frame []byte) bool {
+	if len(frame) < 18 || !bytes.HasPrefix(frame, markerChunk) {
+		return false
+	}
+	return isControl(int64(binary.LittleEndian.Uint64(frame[10:])))
+}
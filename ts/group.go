@@ -0,0 +1,116 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	markerGroupBegin  = []byte{asciiGS, 'B'} // GS "B"
+	markerGroupCommit = []byte{asciiGS, 'C'} // GS "C"
+)
+
+// BeginGroup starts a group of chunks that a reader applies as a whole.
+// Buffered rows are flushed before the group starts. Groups cannot be nested.
+func (w *Writer) BeginGroup() {
+	if w.err != nil {
+		return
+	}
+	if w.inGroup {
+		w.err = errors.New("ts: group already started")
+		return
+	}
+	w.Flush()
+	w.writeHeader()
+	if w.err != nil {
+		return
+	}
+	w.inGroup = true
+	if _, err := w.w.Write(markerGroupBegin); err != nil {
+		w.err = err
+	}
+}
+
+// CommitGroup flushes the rows written since BeginGroup and ends the group.
+//
+// If the stream is canceled before CommitGroup, a reader discards the
+// rows of the group.
+func (w *Writer) CommitGroup() {
+	if w.err != nil {
+		return
+	}
+	if !w.inGroup {
+		w.err = errors.New("ts: commit without a group")
+		return
+	}
+	w.Flush()
+	if w.err != nil {
+		return
+	}
+	w.inGroup = false
+	if _, err := w.w.Write(markerGroupCommit); err != nil {
+		w.err = err
+	}
+}
+
+// readGroup reads the chunks of a group up to the commit marker.
+// Rows of the group are read from the returned buffer. If the stream
+// is canceled or ends before the group is committed, the group is
+// discarded and an error is returned.
+func (r *Reader) readGroup() (*bytes.Reader, error) {
+	buf := &bytes.Buffer{}
+	marker := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r.r, marker); err != nil {
+			return nil, readError(err)
+		}
+		switch {
+		default:
+			return nil, errors.New("ts: invalid marker in group")
+		case bytes.Equal(marker, fileCancel):
+			return nil, ErrStreamCancel
+		case bytes.Equal(marker, fileEOF):
+			return nil, errors.New("ts: end of stream in group")
+		case bytes.Equal(marker, markerGroupBegin):
+			return nil, errors.New("ts: nested group")
+		case bytes.Equal(marker, markerGroupCommit):
+			return bytes.NewReader(buf.Bytes()), nil
+		case bytes.Equal(marker, markerChunk):
+		}
+		size := make([]byte, 8)
+		if _, err := io.ReadFull(r.r, size); err != nil {
+			return nil, readError(err)
+		}
+		buf.Write(marker)
+		buf.Write(size)
+		n := int64(binary.LittleEndian.Uint64(size))
+		if n < 0 {
+			return nil, errors.New("ts: invalid chunk size in group")
+		}
+		if _, err := io.CopyN(buf, r.r, n); err != nil {
+			return nil, readError(err)
+		}
+	}
+}
+
+// Group returns the group of the current row, or zero if the row is not
+// in a group. Groups are numbered from one in stream order. Rows of a group
+// are only returned once the whole group has been read, so a change of group
+// marks a boundary where the previous group is complete.
+func (r *Reader) Group() int64 {
+	if r.rt == nil {
+		return 0
+	}
+	return r.chunkGroup
+}
+
+// Group returns the group of the current row.
+func (c *Cursor) Group() int64 {
+	return c.r.Group()
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IntegrityError is returned by a Writer when a table or column uses an
+// unknown tag, or when a Writer that checks integrity writes a row with
+// a duplicate key or a link to a missing row.
+type IntegrityError struct {
+	Table  string
+	Column string
+	Value  interface{}
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	if len(e.Column) == 0 {
+		return fmt.Sprintf("ts: %s value %v: %s", e.Table, e.Value, e.Reason)
+	}
+	return fmt.Sprintf("ts: %s.%s value %v: %s", e.Table, e.Column, e.Value, e.Reason)
+}
+
+// CheckIntegrity sets whether the writer checks the rows it writes.
+// When set, inserting a key that was already written for the table and
+// writing a link value that is not the key of a row written for the linked
+// table are errors.
+// Rows of the linked table must be written before the rows that link to them.
+//
+// Keys are tracked from the time CheckIntegrity is set, so it should be set
+// before any rows are written. The keys of all rows are held in memory.
+func (w *Writer) CheckIntegrity(check bool) {
+	w.check = check
+}
+
+// trackKeys reports whether the keys of table tid are tracked.
+// The control tables are always tracked, so links to control rows can be checked.
+func (w *Writer) trackKeys(tid int64) bool {
+	return w.check || isControl(tid)
+}
+
+// checkRow checks a row about to be written and records its key.
+func (w *Writer) checkRow(ti *tableInfo, kind RowKind, names []string, values []interface{}) error {
+	if !w.trackKeys(ti.ID) {
+		return nil
+	}
+	byName := make(map[string]interface{}, len(names))
+	for i, name := range names {
+		if i < len(values) {
+			byName[name] = values[i]
+		}
+	}
+	var key Key
+	var keyNames []string
+	for _, c := range ti.Columns {
+		v := byName[c.Name]
+		if c.Key {
+			key = append(key, keyValue(v))
+			keyNames = append(keyNames, c.Name)
+		}
+		if !w.check || c.Link == 0 || v == nil || kind == RowDelete {
+			continue
+		}
+		if _, set := byName[c.Name]; !set {
+			continue
+		}
+		if err := w.checkLink(ti, &c, v); err != nil {
+			return err
+		}
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	keys := w.keys[ti.ID]
+	if keys == nil {
+		keys = make(map[string]bool)
+		w.keys[ti.ID] = keys
+	}
+	ks := keyString(key)
+	switch kind {
+	case RowData:
+		if keys[ks] {
+			var v interface{} = key
+			if len(key) == 1 {
+				v = key[0]
+			}
+			return &IntegrityError{Table: ti.Name, Column: strings.Join(keyNames, ","), Value: v, Reason: "duplicate key"}
+		}
+		keys[ks] = true
+	case RowDelete:
+		delete(keys, ks)
+	}
+	return nil
+}
+
+// checkLink checks that v is the key of a row of the table linked by c.
+func (w *Writer) checkLink(ti *tableInfo, c *Col, v interface{}) error {
+	lt, ok := w.table[c.Link]
+	if !ok {
+		return &IntegrityError{Table: ti.Name, Column: c.Name, Value: v, Reason: fmt.Sprintf("link to unknown table %d", c.Link)}
+	}
+	if n := len(lt.keyColumns()); n != 1 {
+		return &IntegrityError{Table: ti.Name, Column: c.Name, Value: v, Reason: fmt.Sprintf("linked table %q has %d key columns, want 1", lt.Name, n)}
+	}
+	if !w.keys[lt.ID][keyString(Key{keyValue(v)})] {
+		return &IntegrityError{Table: ti.Name, Column: c.Name, Value: v, Reason: fmt.Sprintf("no row in linked table %q", lt.Name)}
+	}
+	return nil
+}
+
+// keyValue returns v with the integer types the coders accept as int64,
+// so equal keys have equal key strings.
+func keyValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case Type:
+		return int64(x)
+	case Tag:
+		return int64(x)
+	}
+	return v
+}
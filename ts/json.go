@@ -0,0 +1,496 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// maxJSONInt is the largest integer a JSON number holds exactly
+// in a float64, as used by JavaScript.
+const maxJSONInt = 1 << 53
+
+// jsonDoc is a line of NDJSON: a list of table definitions or a row.
+type jsonDoc struct {
+	Tables []jsonTable                `json:"tables,omitempty"`
+	Table  string                     `json:"table,omitempty"`
+	Kind   string                     `json:"kind,omitempty"`
+	Values map[string]json.RawMessage `json:"values,omitempty"`
+}
+
+type jsonTable struct {
+	Name    string       `json:"name"`
+	Comment string       `json:"comment,omitempty"`
+	Tags    []string     `json:"tags,omitempty"`
+	Columns []jsonColumn `json:"columns"`
+}
+
+type jsonColumn struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Link     string          `json:"link,omitempty"`
+	Key      bool            `json:"key,omitempty"`
+	Nullable bool            `json:"nullable,omitempty"`
+	Length   int64           `json:"length,omitempty"`
+	Default  json.RawMessage `json:"default,omitempty"`
+	Zero     bool            `json:"zero,omitempty"` // Default is Zero.
+	Comment  string          `json:"comment,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+}
+
+// jsonAny is the JSON form of a value of an Any column.
+type jsonAny struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ToJSON writes the stream read from in to out as NDJSON, one JSON
+// document per line.
+//
+// The first line is a header that defines the tables read before the
+// first row:
+//
+//	{"tables":[{"name":"person","columns":[{"name":"id","type":"int64","key":true}, ...]}]}
+//
+// Each row is then written as an object with the table name and the
+// values by column name:
+//
+//	{"table":"person","values":{"id":1,"name":"Ann"}}
+//
+// Update and delete rows have a "kind" of "update" or "delete" and only
+// the values of the columns they set. A table defined or redefined after
+// the first row is written in a "tables" line before its first row.
+// Links are written as the name of the linked table and tags by name.
+// The rows of control tables are not written.
+//
+// Int64 values are JSON numbers, or strings if they are too large for
+// a float64 to hold exactly. Bytes and Hash values are base64 strings.
+// An Any value is an object with the "type" name and the "value".
+func ToJSON(out io.Writer, in io.Reader) error {
+	r := NewReader(in)
+	bw := bufio.NewWriter(out)
+	described := make(map[int64][32]byte)
+	describe := func() error {
+		var tables []jsonTable
+		for _, def := range r.Tables() {
+			rt := r.table[def.ID]
+			if v, ok := described[def.ID]; ok && v == rt.version {
+				continue
+			}
+			described[def.ID] = rt.version
+			jt, err := r.jsonTable(def)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, jt)
+		}
+		if tables == nil && len(described) > 0 {
+			return nil
+		}
+		if tables == nil {
+			tables = []jsonTable{}
+		}
+		return writeJSONLine(bw, struct {
+			Tables []jsonTable `json:"tables"`
+		}{tables})
+	}
+	buf := &bytes.Buffer{}
+	first := true
+	for r.Next() {
+		if v, ok := described[r.rt.ID]; first || !ok || v != r.rt.version {
+			if err := describe(); err != nil {
+				return err
+			}
+			first = false
+		}
+		values, err := r.Values()
+		if err != nil {
+			return err
+		}
+		cols := r.Columns()
+		kind := r.Kind()
+		changed := r.Changed()
+
+		buf.Reset()
+		buf.WriteString(`{"table":`)
+		writeJSONString(buf, r.rt.Name)
+		if kind != RowData {
+			buf.WriteString(`,"kind":`)
+			writeJSONString(buf, kind.String())
+		}
+		buf.WriteString(`,"values":{`)
+		n := 0
+		for i, c := range cols {
+			if !changed[i] {
+				continue
+			}
+			if n > 0 {
+				buf.WriteByte(',')
+			}
+			n++
+			writeJSONString(buf, c.Name)
+			buf.WriteByte(':')
+			b, err := jsonColumnValue(c.Type, values[i])
+			if err != nil {
+				return fmt.Errorf("ts: column %s.%s: %v", r.rt.Name, c.Name, err)
+			}
+			buf.Write(b)
+		}
+		buf.WriteString("}}\n")
+		if _, err := bw.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	// Define tables without rows.
+	if err := describe(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+// jsonTable returns the JSON form of a table definition.
+func (r *Reader) jsonTable(def TableDef) (jsonTable, error) {
+	jt := jsonTable{
+		Name:    def.Name,
+		Comment: def.Comment,
+		Tags:    r.tagNames(def.Tags),
+		Columns: make([]jsonColumn, len(def.Columns)),
+	}
+	for i, c := range def.Columns {
+		jc := jsonColumn{
+			Name:     c.Name,
+			Type:     c.Type.String(),
+			Key:      c.Key,
+			Nullable: c.Nullable,
+			Length:   c.Length,
+			Comment:  c.Comment,
+			Tags:     r.tagNames(c.Tags),
+		}
+		if c.Link != 0 {
+			lt, ok := r.table[c.Link]
+			if !ok {
+				return jt, fmt.Errorf("ts: column %s.%s links to unknown table %d", def.Name, c.Name, c.Link)
+			}
+			jc.Link = lt.Name
+		}
+		switch c.Default.(type) {
+		case nil:
+		case zero:
+			jc.Zero = true
+		default:
+			b, err := jsonColumnValue(c.Type, c.Default)
+			if err != nil {
+				return jt, fmt.Errorf("ts: default of %s.%s: %v", def.Name, c.Name, err)
+			}
+			jc.Default = b
+		}
+		jt.Columns[i] = jc
+	}
+	return jt, nil
+}
+
+// tagNames returns the names of tags.
+func (r *Reader) tagNames(tags Tags) []string {
+	var names []string
+	for _, tag := range tags {
+		name := r.TagName(tag)
+		if len(name) == 0 {
+			name = fmt.Sprintf("tag%d", tag)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// jsonValue returns the JSON form of a column value.
+func jsonValue(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return []byte("null"), nil
+	case int64:
+		if x > maxJSONInt || x < -maxJSONInt {
+			return json.Marshal(strconv.FormatInt(x, 10))
+		}
+		return []byte(strconv.FormatInt(x, 10)), nil
+	case int:
+		return jsonValue(int64(x))
+	case Type:
+		return jsonValue(int64(x))
+	case Tag:
+		return jsonValue(int64(x))
+	case bool, string:
+		return json.Marshal(x)
+	case []byte:
+		return json.Marshal(base64.StdEncoding.EncodeToString(x))
+	case [32]byte:
+		return json.Marshal(base64.StdEncoding.EncodeToString(x[:]))
+	}
+	return nil, fmt.Errorf("unknown value type %T", v)
+}
+
+// jsonColumnValue returns the JSON form of a value of a column of type t.
+// A value of an Any column is an object with its type and value.
+func jsonColumnValue(t Type, v interface{}) ([]byte, error) {
+	if t != Any || v == nil {
+		return jsonValue(v)
+	}
+	at, ok := anyType(v)
+	if !ok {
+		return nil, fmt.Errorf("unknown value type %T", v)
+	}
+	if at == 0 {
+		return json.Marshal(jsonAny{Type: "zero"})
+	}
+	b, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonAny{Type: at.String(), Value: b})
+}
+
+// typeByName returns the builtin type with the given name.
+func typeByName(name string) (Type, bool) {
+	for _, ft := range builtinFieldTypes {
+		if ft.Name == name {
+			return ft.Type, true
+		}
+	}
+	return 0, false
+}
+
+// parseJSONValue returns the value of column type t from its JSON form.
+func parseJSONValue(t Type, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	switch t {
+	case Int64:
+		var s string
+		if raw[0] == '"' {
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, err
+			}
+		} else {
+			s = string(raw)
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case Bool:
+		var b bool
+		err := json.Unmarshal(raw, &b)
+		return b, err
+	case String:
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case Bytes, Hash:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		if t == Bytes {
+			return b, nil
+		}
+		var h [32]byte
+		if len(b) != len(h) {
+			return nil, fmt.Errorf("hash has %d bytes, want %d", len(b), len(h))
+		}
+		copy(h[:], b)
+		return h, nil
+	case Any:
+		var a jsonAny
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return nil, err
+		}
+		if a.Type == "zero" {
+			return Zero, nil
+		}
+		at, ok := typeByName(a.Type)
+		if !ok || at == Any {
+			return nil, fmt.Errorf("unknown any type %q", a.Type)
+		}
+		return parseJSONValue(at, a.Value)
+	}
+	return nil, fmt.Errorf("unknown type %v", t)
+}
+
+// FromJSON reads NDJSON in the form written by ToJSON from in and writes
+// the tables and rows to w. Tables are defined and redefined as listed
+// in "tables" documents, and a row must be for a table already listed.
+// Tags are defined by name. Int64 values may be JSON numbers or strings.
+func FromJSON(w *Writer, in io.Reader) error {
+	dec := json.NewDecoder(in)
+	tables := make(map[string]TableRef)
+	cols := make(map[string][]Col)
+	for n := 1; ; n++ {
+		var doc jsonDoc
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("ts: json document %d: %v", n, err)
+		}
+		for _, jt := range doc.Tables {
+			t, tc, err := w.jsonDef(jt)
+			if err != nil {
+				return fmt.Errorf("ts: json document %d: %v", n, err)
+			}
+			tref, ok := tables[t.Name]
+			switch {
+			case !ok:
+				tref = w.Define(t, tc...)
+			case !reflect.DeepEqual(cols[t.Name], tc):
+				tref = w.Redefine(tref, tc...)
+			}
+			tables[t.Name] = tref
+			cols[t.Name] = tc
+		}
+		if len(doc.Table) > 0 {
+			tref, ok := tables[doc.Table]
+			if !ok {
+				return fmt.Errorf("ts: json document %d: table %q not defined", n, doc.Table)
+			}
+			if err := w.jsonRow(tref, cols[doc.Table], &doc); err != nil {
+				return fmt.Errorf("ts: json document %d: %v", n, err)
+			}
+		}
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("ts: json document %d: %v", n, err)
+		}
+	}
+}
+
+// jsonDef returns the table and columns of a JSON table definition.
+func (w *Writer) jsonDef(jt jsonTable) (Table, []Col, error) {
+	t := Table{Name: jt.Name, Comment: jt.Comment, Tags: w.defineTags(jt.Tags)}
+	cols := make([]Col, len(jt.Columns))
+	for i, jc := range jt.Columns {
+		ct, ok := typeByName(jc.Type)
+		if !ok {
+			return t, nil, fmt.Errorf("column %s.%s has unknown type %q", jt.Name, jc.Name, jc.Type)
+		}
+		c := Col{
+			Name:     jc.Name,
+			Type:     ct,
+			Key:      jc.Key,
+			Nullable: jc.Nullable,
+			Length:   jc.Length,
+			Comment:  jc.Comment,
+			Tags:     w.defineTags(jc.Tags),
+		}
+		if len(jc.Link) > 0 {
+			lt, ok := w.Lookup(jc.Link)
+			if !ok {
+				return t, nil, fmt.Errorf("column %s.%s links to undefined table %q", jt.Name, jc.Name, jc.Link)
+			}
+			c.Link = lt.ID()
+		}
+		switch {
+		case jc.Zero:
+			c.Default = Zero
+		case len(jc.Default) > 0:
+			v, err := parseJSONValue(ct, jc.Default)
+			if err != nil {
+				return t, nil, fmt.Errorf("default of %s.%s: %v", jt.Name, jc.Name, err)
+			}
+			c.Default = v
+		}
+		cols[i] = c
+	}
+	return t, cols, nil
+}
+
+// defineTags returns the tags with the given names, defining them if needed.
+func (w *Writer) defineTags(names []string) Tags {
+	var tags Tags
+	for _, name := range names {
+		tags = append(tags, w.DefineTag(name))
+	}
+	return tags
+}
+
+// jsonRow writes the row of a JSON document.
+func (w *Writer) jsonRow(t TableRef, cols []Col, doc *jsonDoc) error {
+	name := doc.Table
+	var names []string
+	var values []interface{}
+	var key Key
+	for _, c := range cols {
+		raw, ok := doc.Values[c.Name]
+		if !ok {
+			continue
+		}
+		v, err := parseJSONValue(c.Type, raw)
+		if err != nil {
+			return fmt.Errorf("column %s.%s: %v", name, c.Name, err)
+		}
+		if c.Key {
+			key = append(key, v)
+			if doc.Kind == RowUpdate.String() {
+				continue
+			}
+		}
+		names = append(names, c.Name)
+		values = append(values, v)
+	}
+	for col := range doc.Values {
+		if !hasColumn(cols, col) {
+			return fmt.Errorf("unknown column %s.%s", name, col)
+		}
+	}
+	var k interface{} = key
+	if len(key) == 1 {
+		k = key[0]
+	}
+	switch doc.Kind {
+	case "", RowData.String():
+		w.Insert(t.Use(names...), values...)
+	case RowUpdate.String():
+		w.Update(t.Use(names...), k, values...)
+	case RowDelete.String():
+		w.Delete(t, k)
+	default:
+		return fmt.Errorf("unknown row kind %q", doc.Kind)
+	}
+	return nil
+}
+
+func hasColumn(cols []Col, name string) bool {
+	for _, c := range cols {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
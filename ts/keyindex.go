@@ -0,0 +1,416 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// markerIndex starts the key index written before the end of the stream.
+//
+//	FS "I" <size int64> <entry-count int64>
+//	    [<table ID int64> <chunk offset int64> <key size int64> <key row>]
+//	    <index offset int64>
+//
+// The key row of a chunk of a control table is empty. For other tables it
+// is a data row with only the key columns of the first row of the chunk.
+// The index offset is the offset of the index marker from the start of
+// the stream, so the index can be found from the end of the stream.
+var markerIndex = []byte{asciiFS, 'I'}
+
+// ErrKeyNotFound is returned by Lookup if no row has the key.
+var ErrKeyNotFound = errors.New("ts: key not found")
+
+// ErrNotIndexed is returned by Lookup if the stream has no key index or
+// the table is not in it. The rows of the table may still be read in order.
+var ErrNotIndexed = errors.New("ts: table not in key index")
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// indexEntry is a chunk in the key index.
+type indexEntry struct {
+	tid    int64
+	offset int64
+	key    []byte // Key row of the first row, empty for control tables.
+}
+
+// KeyIndex sets whether the writer writes a key index at the end of the
+// stream. The index holds the offset of each chunk and the key of the
+// first row of each chunk of a table with key columns, so Reader.Lookup
+// can find a row by reading a single chunk.
+//
+// Only tables tagged with the tag named SortedTagName, as written by
+// SortTable, are indexed. Tables changed with Redefine are not indexed.
+func (w *Writer) KeyIndex(index bool) {
+	w.index = index
+}
+
+// addIndex adds the chunk for rows of table tid, about to be written,
+// to the key index.
+func (w *Writer) addIndex(tid int64, rows [][]byte) {
+	if !w.index || w.err != nil {
+		return
+	}
+	if isControl(tid) {
+		w.indexChunk = append(w.indexChunk, indexEntry{tid: tid, offset: w.out.n})
+		return
+	}
+	ti := w.table[tid]
+	if ti == nil || ti.versioned || len(ti.keyColumns()) == 0 || !w.sorted(ti) {
+		return
+	}
+	for _, row := range rows {
+		if !isRowKind(row[1]) {
+			continue
+		}
+		key, err := w.keyRow(ti, row)
+		if err != nil {
+			w.err = err
+			return
+		}
+		w.indexChunk = append(w.indexChunk, indexEntry{tid: tid, offset: w.out.n, key: key})
+		return
+	}
+}
+
+// sorted reports whether ti is tagged with the tag named SortedTagName.
+func (w *Writer) sorted(ti *tableInfo) bool {
+	for _, tag := range ti.Tags {
+		if w.tags[tag] == SortedTagName {
+			return true
+		}
+	}
+	return false
+}
+
+// keyRow returns a data row with the key columns of row.
+func (w *Writer) keyRow(ti *tableInfo, row []byte) ([]byte, error) {
+	ncol := len(ti.Columns)
+	maskLen := (ncol + 7) / 8
+	pos := int64(2 + maskLen)
+	if RowKind(row[1]) == RowUpdate {
+		pos += int64(maskLen)
+	}
+	if int64(len(row)) < pos {
+		return nil, fmt.Errorf("ts: short row for table %q", ti.Name)
+	}
+	mask := row[2 : 2+maskLen]
+	key := make([]byte, 2+maskLen)
+	key[0], key[1] = asciiRS, byte(RowData)
+	for i, c := range ti.Columns {
+		bit := byte(1 << uint(i%8))
+		if mask[i/8]&bit == 0 {
+			continue
+		}
+		start := pos
+		size := fixedByteSize(w.field[c.Type].BitSize())
+		if size == 0 {
+			if pos+8 > int64(len(row)) {
+				return nil, fmt.Errorf("ts: short row for %s.%s", ti.Name, c.Name)
+			}
+			size = int64(binary.LittleEndian.Uint64(row[pos:]))
+			pos += 8
+		}
+		pos += size
+		if size < 0 || pos > int64(len(row)) {
+			return nil, fmt.Errorf("ts: short row for %s.%s", ti.Name, c.Name)
+		}
+		if c.Key {
+			key[2+i/8] |= bit
+			key = append(key, row[start:pos]...)
+		}
+	}
+	return key, nil
+}
+
+// writeIndex writes the key index if it is set.
+func (w *Writer) writeIndex() {
+	if !w.index {
+		return
+	}
+	w.writeHeader()
+	start := w.out.n
+	// Drop the chunks of tables redefined after they were indexed.
+	var entries []indexEntry
+	for _, e := range w.indexChunk {
+		if ti := w.table[e.tid]; isControl(e.tid) || (ti != nil && !ti.versioned) {
+			entries = append(entries, e)
+		}
+	}
+	buf := &bytes.Buffer{}
+	put := func(v int64) {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(v))
+		buf.Write(b[:])
+	}
+	buf.Write(markerIndex)
+	put(0) // Size, set below.
+	put(int64(len(entries)))
+	for _, e := range entries {
+		put(e.tid)
+		put(e.offset)
+		put(int64(len(e.key)))
+		buf.Write(e.key)
+	}
+	put(start)
+	index := buf.Bytes()
+	binary.LittleEndian.PutUint64(index[2:], uint64(len(index)-10))
+	if _, err := w.w.Write(index); err != nil {
+		w.err = err
+	}
+}
+
+// skipIndex skips the key index when reading a stream in order.
+func skipIndex(src io.Reader) error {
+	var size int64
+	if err := binary.Read(src, binary.LittleEndian, &size); err != nil {
+		return readError(err)
+	}
+	if size < 16 {
+		return fmt.Errorf("ts: invalid index size %d", size)
+	}
+	if _, err := io.CopyN(ioutil.Discard, src, size); err != nil {
+		return readError(err)
+	}
+	return nil
+}
+
+// keyIndex is the key index of a stream read with random access.
+type keyIndex struct {
+	ra      io.ReaderAt
+	size    int64
+	entries map[int64][]indexEntry // Chunks of each table in stream order.
+	r       *Reader                // Reads the schema and chunks.
+}
+
+// readerSize returns the size of the stream read by ra.
+func readerSize(ra io.ReaderAt) (int64, error) {
+	switch x := ra.(type) {
+	case interface{ Size() int64 }:
+		return x.Size(), nil
+	case io.Seeker:
+		cur, err := x.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		end, err := x.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		_, err = x.Seek(cur, io.SeekStart)
+		return end, err
+	}
+	return 0, errors.New("ts: unknown stream size")
+}
+
+// loadIndex reads the key index from the end of the stream and the
+// control chunks it lists.
+func (r *Reader) loadIndex() (*keyIndex, error) {
+	if r.index != nil {
+		return r.index, nil
+	}
+	ra, ok := r.src.(io.ReaderAt)
+	if !ok {
+		return nil, errors.New("ts: lookup needs a stream that implements io.ReaderAt")
+	}
+	size, err := readerSize(ra)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(len(fileHeader))+28 {
+		return nil, ErrNotIndexed
+	}
+	tail := make([]byte, 10)
+	if _, err := ra.ReadAt(tail, size-10); err != nil {
+		return nil, err
+	}
+	start := int64(binary.LittleEndian.Uint64(tail))
+	if !bytes.Equal(tail[8:], fileEOF) || start < int64(len(fileHeader)) || start > size-28 {
+		return nil, ErrNotIndexed
+	}
+	index := make([]byte, size-2-start)
+	if _, err := ra.ReadAt(index, start); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(index[:2], markerIndex) || int64(binary.LittleEndian.Uint64(index[2:])) != int64(len(index)-10) {
+		return nil, ErrNotIndexed
+	}
+
+	ki := &keyIndex{
+		ra:      ra,
+		size:    size,
+		entries: make(map[int64][]indexEntry),
+		r:       NewReader(nil),
+	}
+	ki.r.started = true
+	ki.r.targets = r.targets
+	errIndex := errors.New("ts: invalid key index")
+	at := 10
+	next := func() (int64, error) {
+		if at+8 > len(index)-8 {
+			return 0, errIndex
+		}
+		v := int64(binary.LittleEndian.Uint64(index[at:]))
+		at += 8
+		return v, nil
+	}
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		var e indexEntry
+		var n int64
+		for _, v := range []*int64{&e.tid, &e.offset, &n} {
+			if *v, err = next(); err != nil {
+				return nil, err
+			}
+		}
+		if n < 0 || int64(at)+n > int64(len(index)-8) || e.offset < 0 || e.offset >= start {
+			return nil, errIndex
+		}
+		e.key = index[at : int64(at)+n]
+		at += int(n)
+		if isControl(e.tid) {
+			// Apply the schema in stream order.
+			if _, err := ki.chunk(e.offset, func(*readTable) bool { return false }); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ki.entries[e.tid] = append(ki.entries[e.tid], e)
+	}
+	r.index = ki
+	return ki, nil
+}
+
+// chunk reads the chunk at offset.
+func (ki *keyIndex) chunk(offset int64, match func(rt *readTable) bool) (*readTable, error) {
+	r := ki.r
+	r.r = bufio.NewReader(io.NewSectionReader(ki.ra, offset, ki.size-offset))
+	r.group = nil
+	r.rows = r.rows[:0]
+	return r.nextChunk(match)
+}
+
+// Lookup returns the values of the row of the named table with the key
+// values of the key columns in column order, or ErrKeyNotFound.
+//
+// Lookup reads the key index written with Writer.KeyIndex and the single
+// chunk that may hold the key, so it needs the stream passed to NewReader
+// to implement io.ReaderAt. The table must be sorted by key and tagged as
+// by SortTable, and must not be redefined; otherwise ErrNotIndexed is
+// returned. Lookup does not change the row read by Next.
+func (r *Reader) Lookup(table string, key ...interface{}) ([]interface{}, error) {
+	ki, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var rt *readTable
+	for _, t := range ki.r.table {
+		if t.Name == table && !isControl(t.ID) {
+			rt = t
+		}
+	}
+	if rt == nil {
+		return nil, fmt.Errorf("ts: table %q not in stream", table)
+	}
+	if !ki.r.sorted(rt) || rt.versions != nil {
+		return nil, ErrNotIndexed
+	}
+	var keyCols []int
+	for i, c := range rt.Columns {
+		if c.Key {
+			keyCols = append(keyCols, i)
+		}
+	}
+	if len(keyCols) != len(key) {
+		return nil, fmt.Errorf("ts: table %q has %d key columns, got %d key values", table, len(keyCols), len(key))
+	}
+	want := make(Key, len(key))
+	for i, v := range key {
+		want[i] = keyValue(v)
+	}
+	first := func(e indexEntry) (Key, error) {
+		values, err := ki.r.decodeRow(rt, e.key, keyCols)
+		return Key(values), err
+	}
+
+	entries := ki.entries[rt.ID]
+	var searchErr error
+	at := sort.Search(len(entries), func(i int) bool {
+		k, err := first(entries[i])
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return compareKey(k, want) >= 0
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	if at > 0 {
+		at--
+	}
+	for ; at < len(entries); at++ {
+		k, err := first(entries[at])
+		if err != nil {
+			return nil, err
+		}
+		if compareKey(k, want) > 0 {
+			break
+		}
+		values, err := ki.find(entries[at].offset, rt, keyCols, want)
+		if err != nil || values != nil {
+			return values, err
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// find returns the values of the row with key want in the chunk at offset,
+// or nil if the chunk does not have the key.
+func (ki *keyIndex) find(offset int64, rt *readTable, keyCols []int, want Key) ([]interface{}, error) {
+	match := func(t *readTable) bool { return t == rt }
+	if _, err := ki.chunk(offset, match); err != nil {
+		return nil, err
+	}
+	r := ki.r
+	for i, o := range r.rows {
+		if RowKind(o.Type) != RowData {
+			continue
+		}
+		end := int64(len(r.chunk))
+		if i+1 < len(r.rows) {
+			end = r.rows[i+1].Offset
+		}
+		row := r.chunk[o.Offset:end]
+		k, err := r.decodeRow(rt, row, keyCols)
+		if err != nil {
+			return nil, err
+		}
+		if compareKey(k, want) == 0 {
+			return r.viewRow(rt, row, nil)
+		}
+	}
+	return nil, nil
+}
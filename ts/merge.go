@@ -0,0 +1,507 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// MergeOptions controls how Merge combines streams.
+type MergeOptions struct {
+	// SortByKey sorts the rows of each table with key columns by key and
+	// keeps only the row from the last input for each key. The inputs
+	// must only hold data rows, and all rows are held in memory.
+	SortByKey bool
+}
+
+// Merge writes the tables of all inputs to out as a single stream.
+// See MergeOptions.Merge.
+func Merge(out io.Writer, inputs ...io.Reader) error {
+	return MergeOptions{}.Merge(out, inputs...)
+}
+
+// Merge writes the tables of all inputs to out as a single stream.
+//
+// Tables and tags are matched by name and given new IDs in out where
+// needed; links are matched by the name of the linked table. The first
+// input to define a table sets its columns in out. A later input must
+// define the table with the same key columns and links, and each of its
+// columns must be in out and be readable as the column in out, as
+// in Reader.Expect.
+//
+// When an input redefines a table, the table in out is redefined with
+// the new columns of the input; rows held for sorting are mapped to the
+// new columns by name and the key columns may not change.
+//
+// Chunks of a table with the same columns in the input and out are copied
+// without decoding the rows, other chunks are read with the columns of out.
+// Validation rows are not copied.
+func (o MergeOptions) Merge(out io.Writer, inputs ...io.Reader) error {
+	m := &merger{
+		w:      NewWriter(out),
+		sort:   o.SortByKey,
+		byName: make(map[string]*mergeTable),
+	}
+	for _, in := range inputs {
+		if err := m.read(in); err != nil {
+			return err
+		}
+	}
+	if m.sort {
+		m.writeSorted()
+	}
+	return m.w.Close()
+}
+
+type merger struct {
+	w      *Writer
+	sort   bool
+	tables []*mergeTable
+	byName map[string]*mergeTable
+	ext    *extSort // Sort of a table by SortTable, or nil.
+}
+
+// mergeTable is a table of the merged stream.
+type mergeTable struct {
+	ref   TableRef
+	ti    *tableInfo
+	links []string  // Name of the linked table for each column.
+	rows  *memTable // Rows held for sorting, nil unless sorting.
+	ext   bool      // Rows are sorted by m.ext.
+}
+
+// inputTable is a table of an input stream matched to a merged table.
+type inputTable struct {
+	mt      *mergeTable
+	version [32]byte
+	same    bool // Columns of the input and merged table are the same.
+}
+
+// read copies the tables of in to the merged stream.
+func (m *merger) read(in io.Reader) error {
+	r := NewReader(in)
+	seen := make(map[int64]*inputTable)
+	user := func(rt *readTable) bool {
+		return !isControl(rt.ID)
+	}
+	for {
+		rt, err := r.nextChunk(user)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rt == nil {
+			continue
+		}
+		if err := m.match(r, seen); err != nil {
+			return err
+		}
+		if err := m.chunk(r, rt, seen[rt.ID]); err != nil {
+			return err
+		}
+	}
+	// Add tables without rows.
+	return m.match(r, seen)
+}
+
+// match matches the tables of r not yet seen, or seen with another version,
+// to merged tables.
+func (m *merger) match(r *Reader, seen map[int64]*inputTable) error {
+	for _, def := range r.Tables() {
+		rt := r.table[def.ID]
+		prev, ok := seen[def.ID]
+		if ok && prev.version == rt.version {
+			continue
+		}
+		it, err := m.matchTable(r, rt, prev)
+		if err != nil {
+			return err
+		}
+		seen[def.ID] = it
+	}
+	return nil
+}
+
+// matchTable matches rt to the merged table of the same name, defining it
+// if needed. If prev is set the input redefined the table matched by prev.
+func (m *merger) matchTable(r *Reader, rt *readTable, prev *inputTable) (*inputTable, error) {
+	cols := make([]Col, len(rt.Columns))
+	links := make([]string, len(cols))
+	for i, c := range rt.Columns {
+		cols[i] = c
+		if c.Link != 0 {
+			lt, ok := r.table[c.Link]
+			if !ok {
+				return nil, fmt.Errorf("ts: column %s.%s links to unknown table %d", rt.Name, c.Name, c.Link)
+			}
+			links[i] = lt.Name
+		}
+		tags, err := m.tags(r, c.Tags)
+		if err != nil {
+			return nil, err
+		}
+		cols[i].Tags = tags
+	}
+	t := rt.Table
+	tags, err := m.tags(r, t.Tags)
+	if err != nil {
+		return nil, err
+	}
+	t.Tags = tags
+
+	mt, ok := m.byName[t.Name]
+	if ok && prev != nil && !(sameColumns(mt.ti.Columns, cols) && reflect.DeepEqual(mt.links, links)) {
+		if err := m.redefine(mt, cols, links); err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		if err := m.linkColumns(t.Name, cols, links); err != nil {
+			return nil, err
+		}
+		ext := m.ext != nil && m.ext.table == t.Name
+		if ext {
+			sorted := m.w.DefineTag(SortedTagName)
+			if !hasTag(t.Tags, sorted) {
+				t.Tags = append(t.Tags, sorted)
+			}
+		}
+		ref := m.w.Define(t, cols...)
+		if err := m.w.Error(); err != nil {
+			return nil, err
+		}
+		mt = &mergeTable{ref: ref, ti: m.w.table[ref.ID()], links: links, ext: ext}
+		if ext {
+			if err := m.ext.define(mt.ti.Columns); err != nil {
+				return nil, err
+			}
+		}
+		if m.sort {
+			mt.rows = newMemTable(TableDef{ID: ref.ID(), Table: t, Columns: mt.ti.Columns}, links)
+		}
+		m.tables = append(m.tables, mt)
+		m.byName[t.Name] = mt
+	}
+
+	it := &inputTable{mt: mt, version: rt.version}
+	if sameColumns(mt.ti.Columns, cols) && reflect.DeepEqual(mt.links, links) {
+		it.same = true
+		delete(r.targets, t.Name)
+		rt.mapping = nil
+		return it, nil
+	}
+	for i, c := range cols {
+		ci := mt.ti.columnIndex(c.Name)
+		if ci < 0 {
+			return nil, fmt.Errorf("ts: column %s.%s is not in the merged table", t.Name, c.Name)
+		}
+		mc := mt.ti.Columns[ci]
+		if mc.Key != c.Key {
+			return nil, fmt.Errorf("ts: column %s.%s key differs from the merged table", t.Name, c.Name)
+		}
+		if mt.links[ci] != links[i] {
+			return nil, fmt.Errorf("ts: column %s.%s link differs from the merged table", t.Name, c.Name)
+		}
+	}
+	for _, mc := range mt.ti.Columns {
+		if mc.Key && rt.columnIndex(mc.Name) < 0 {
+			return nil, fmt.Errorf("ts: key column %s.%s is not in the input", t.Name, mc.Name)
+		}
+	}
+	r.Expect(t.Name, mt.ti.Columns...)
+	if err := r.mapTable(rt); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// linkColumns sets the links of cols to the merged tables named by links.
+func (m *merger) linkColumns(table string, cols []Col, links []string) error {
+	for i := range cols {
+		if len(links[i]) == 0 {
+			continue
+		}
+		lt, ok := m.byName[links[i]]
+		if !ok {
+			return fmt.Errorf("ts: column %s.%s links to table %q not yet merged", table, cols[i].Name, links[i])
+		}
+		cols[i].Link = lt.ref.ID()
+	}
+	return nil
+}
+
+// redefine redefines the merged table with the columns of an input that
+// redefined the table.
+func (m *merger) redefine(mt *mergeTable, cols []Col, links []string) error {
+	cols = append([]Col(nil), cols...)
+	if err := m.linkColumns(mt.ti.Name, cols, links); err != nil {
+		return err
+	}
+	prev := mt.ti
+	ref := m.w.Redefine(mt.ref, cols...)
+	if err := m.w.Error(); err != nil {
+		return err
+	}
+	mt.ref, mt.ti, mt.links = ref, m.w.table[ref.ID()], links
+	if !sameKeyColumns(prev, mt.ti) && (mt.ext || m.sort) {
+		return fmt.Errorf("ts: cannot sort table %q with changed key columns", mt.ti.Name)
+	}
+	if mt.ext {
+		return m.ext.redefine(mt.ti.Columns)
+	}
+	if m.sort {
+		mt.rows.redefine(TableDef{ID: ref.ID(), Table: mt.ti.Table, Columns: mt.ti.Columns}, links)
+	}
+	return nil
+}
+
+// remapRow returns row of columns from with the values of columns to,
+// matched by name. Columns not in from are null.
+func remapRow(row []interface{}, from, to []Col) []interface{} {
+	out := make([]interface{}, len(to))
+	for i, c := range to {
+		for j, f := range from {
+			if f.Name == c.Name {
+				out[i] = row[j]
+				break
+			}
+		}
+	}
+	return out
+}
+
+// tags returns the tags of the merged stream with the names of the input tags.
+func (m *merger) tags(r *Reader, tags Tags) (Tags, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	out := make(Tags, len(tags))
+	for i, tag := range tags {
+		name := r.TagName(tag)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("ts: unknown tag %d", tag)
+		}
+		out[i] = m.w.DefineTag(name)
+	}
+	return out, m.w.Error()
+}
+
+// chunk writes the rows of the current chunk of r.
+func (m *merger) chunk(r *Reader, rt *readTable, it *inputTable) error {
+	mt := it.mt
+	if it.same && !m.sort && !mt.ext && !m.w.index && !mt.ti.versioned && rawRows(r.rows) {
+		m.w.writeChunk(mt.ti.ID, r.chunk)
+		return m.w.Error()
+	}
+	for i, o := range r.rows {
+		if !isRowKind(o.Type) {
+			continue
+		}
+		end := int64(len(r.chunk))
+		if i+1 < len(r.rows) {
+			end = r.rows[i+1].Offset
+		}
+		row := r.chunk[o.Offset:end]
+		values, err := r.viewRow(rt, row, nil)
+		if err != nil {
+			return err
+		}
+		kind := RowKind(o.Type)
+		if mt.ext {
+			if kind != RowData {
+				return fmt.Errorf("ts: cannot sort %v rows of table %q", kind, rt.Name)
+			}
+			if err := m.ext.add(values); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.sort {
+			if kind != RowData {
+				return fmt.Errorf("ts: cannot sort %v rows of table %q", kind, rt.Name)
+			}
+			mt.rows.put(values)
+			continue
+		}
+		changed := rt.viewChanged(rowChanged(row, len(rt.columns)), kind)
+		var names []string
+		var set []interface{}
+		for ci, c := range mt.ti.Columns {
+			if changed[ci] {
+				names = append(names, c.Name)
+				set = append(set, values[ci])
+			}
+		}
+		m.w.writeRow(mt.ti, kind, names, set)
+		if err := m.w.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rawRows reports whether a chunk only has rows that may be copied as is.
+func rawRows(rows []rowOffset) bool {
+	for _, o := range rows {
+		if !isRowKind(o.Type) {
+			return false
+		}
+	}
+	return true
+}
+
+// put adds row, replacing a row with the same key.
+func (mt *memTable) put(row []interface{}) {
+	if len(mt.key) == 0 {
+		mt.rows = append(mt.rows, row)
+		return
+	}
+	_, ks := mt.keyOf(row)
+	if at, ok := mt.idx[ks]; ok {
+		mt.rows[at] = row
+		return
+	}
+	mt.idx[ks] = len(mt.rows)
+	mt.rows = append(mt.rows, row)
+}
+
+// redefine maps the rows to the columns of def. The key columns must not change.
+func (mt *memTable) redefine(def TableDef, links []string) {
+	for i, row := range mt.rows {
+		if row != nil {
+			mt.rows[i] = remapRow(row, mt.def.Columns, def.Columns)
+		}
+	}
+	mt.def, mt.links, mt.key = def, links, nil
+	for i, c := range def.Columns {
+		if c.Key {
+			mt.key = append(mt.key, i)
+		}
+	}
+}
+
+// writeSorted writes the rows held for each table, sorted by key.
+func (m *merger) writeSorted() {
+	for _, mt := range m.tables {
+		rows := mt.rows.rows
+		if len(mt.rows.key) > 0 {
+			sort.SliceStable(rows, func(i, j int) bool {
+				a, _ := mt.rows.keyOf(rows[i])
+				b, _ := mt.rows.keyOf(rows[j])
+				return compareKey(a, b) < 0
+			})
+		}
+		for _, row := range rows {
+			m.w.Insert(mt.ref, row...)
+		}
+	}
+}
+
+// writeChunk writes a chunk read from another stream as a chunk of table tid.
+func (w *Writer) writeChunk(tid int64, chunk []byte) {
+	w.Flush()
+	if w.err != nil {
+		return
+	}
+	w.writeHeader()
+	head := make([]byte, len(markerChunk)+16)
+	copy(head, markerChunk)
+	binary.LittleEndian.PutUint64(head[2:], uint64(len(chunk)))
+	binary.LittleEndian.PutUint64(head[10:], uint64(tid))
+	if _, err := w.w.Write(head); err != nil {
+		w.err = err
+		return
+	}
+	if _, err := w.w.Write(chunk[8:]); err != nil {
+		w.err = err
+		return
+	}
+	w.chunksWritten++
+}
+
+// compareKey compares two keys column by column.
+func compareKey(a, b Key) int {
+	for i := range a {
+		if c := compareValue(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareValue orders two column values. Null sorts first.
+// Values of different types are ordered by type name.
+func compareValue(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case []byte:
+		if y, ok := b.([]byte); ok {
+			return bytes.Compare(x, y)
+		}
+	case [32]byte:
+		if y, ok := b.([32]byte); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0
+			case !x:
+				return -1
+			}
+			return 1
+		}
+	}
+	ta, tb := fmt.Sprintf("%T", a), fmt.Sprintf("%T", b)
+	switch {
+	case ta < tb:
+		return -1
+	case ta > tb:
+		return 1
+	}
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	switch {
+	case sa < sb:
+		return -1
+	case sa > sb:
+		return 1
+	}
+	return 0
+}
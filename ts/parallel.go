@@ -0,0 +1,295 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"io"
+	"sync"
+)
+
+// parallelRows is the number of rows a goroutine encodes at a time on Flush.
+const parallelRows = 4096
+
+// Parallel sets the number of goroutines Flush uses to encode rows.
+// With more than one goroutine, inserted, updated and deleted rows are
+// checked when written and encoded on Flush, the rows of a large table in
+// slices. The output is identical to the output with one
+// goroutine, the default.
+//
+// An invalid value, such as a string over the column length, is then
+// reported by the Flush or Close that encodes it rather than by the write.
+func (w *Writer) Parallel(n int) {
+	if n < 1 {
+		n = 1
+	}
+	w.parallel = n
+}
+
+// pendingRow is a row written with Parallel that is encoded on Flush.
+// Its position in the row buffer of the table is at.
+type pendingRow struct {
+	at     int
+	ti     *tableInfo
+	kind   RowKind
+	names  []string
+	values []interface{}
+}
+
+// deferRow keeps a row to be encoded on Flush. The values are copied so the
+// caller may reuse them.
+func (w *Writer) deferRow(ti *tableInfo, kind RowKind, names []string, values []interface{}) {
+	kept := make([]interface{}, len(values))
+	for i, v := range values {
+		if b, ok := v.([]byte); ok {
+			v = append([]byte(nil), b...)
+		}
+		kept[i] = v
+	}
+	rows := w.rowBuffer[ti.ID]
+	w.pending[ti.ID] = append(w.pending[ti.ID], pendingRow{
+		at:     len(rows),
+		ti:     ti,
+		kind:   kind,
+		names:  names,
+		values: kept,
+	})
+	w.rowBuffer[ti.ID] = append(rows, nil)
+}
+
+// encodePending encodes the pending rows of each table into the row buffer
+// with up to w.parallel goroutines. The error of the first row that fails in
+// table ID and row order is returned.
+func (w *Writer) encodePending(tids []int64) error {
+	var parts [][]pendingRow
+	var rows [][][]byte
+	for _, tid := range tids {
+		pending := w.pending[tid]
+		for start := 0; start < len(pending); start += parallelRows {
+			end := start + parallelRows
+			if end > len(pending) {
+				end = len(pending)
+			}
+			parts = append(parts, pending[start:end])
+			rows = append(rows, w.rowBuffer[tid])
+		}
+	}
+	w.pending = make(map[int64][]pendingRow, 10)
+
+	errs := make([]error, len(parts))
+	sem := make(chan struct{}, w.parallel)
+	var wg sync.WaitGroup
+	for i := range parts {
+		i := i
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			rb := &rowBuilder{}
+			for _, p := range parts[i] {
+				row, err := w.encodeRow(rb, p.ti, p.kind, p.names, p.values)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				rows[i][p.at] = row
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Batch holds the decoded rows of one chunk of a table.
+type Batch struct {
+	Table   Table
+	Columns []Col
+	Version [32]byte
+
+	// Kinds, IDs, Rows and Changed hold the kind, row ID, values and
+	// changed columns of each row. Changed is nil for data rows.
+	Kinds   []RowKind
+	IDs     []int64
+	Rows    [][]interface{}
+	Changed [][]bool
+
+	// Validations holds the validation rows of the chunk.
+	Validations []Validation
+}
+
+// chunkJob is a chunk waiting to be decoded.
+type chunkJob struct {
+	rt     readTable
+	chunk  []byte
+	rows   []rowOffset
+	valid  []Validation
+	result chan batchResult
+}
+
+type batchResult struct {
+	batch *Batch
+	err   error
+}
+
+// ReadParallel reads the stream from in and decodes the chunks of the
+// non-control tables with up to workers goroutines. For each chunk fn
+// is called with the decoded rows.
+//
+// Calls to fn for the same table are made one at a time in stream order.
+// Calls for different tables may be made at the same time. At most
+// twice workers chunks are decoded or waiting for fn at a time.
+//
+// The first error from the stream, from decoding or from fn stops the read
+// and is returned. A canceled stream returns ErrStreamCancel after the rows
+// before the cancel are delivered.
+func ReadParallel(in io.Reader, workers int, fn func(b *Batch) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	r := NewReader(in)
+	limit := 2 * workers
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+		done     = make(chan struct{})
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+
+	jobs := make(chan *chunkJob)
+	inflight := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				b, err := r.decodeBatch(job)
+				job.result <- batchResult{batch: b, err: err}
+			}
+		}()
+	}
+
+	// Each table has a pipeline of results, delivered in stream order.
+	pipes := make(map[int64]chan chan batchResult)
+	var deliver sync.WaitGroup
+	pipe := func(tid int64) chan chan batchResult {
+		p, ok := pipes[tid]
+		if ok {
+			return p
+		}
+		p = make(chan chan batchResult, limit)
+		pipes[tid] = p
+		deliver.Add(1)
+		go func() {
+			defer deliver.Done()
+			for result := range p {
+				res := <-result
+				select {
+				case <-done:
+				default:
+					err := res.err
+					if err == nil {
+						err = fn(res.batch)
+					}
+					if err != nil {
+						fail(err)
+					}
+				}
+				<-inflight
+			}
+		}()
+		return p
+	}
+
+	var readErr error
+	user := func(rt *readTable) bool {
+		return !isControl(rt.ID)
+	}
+read:
+	for {
+		nvalid := len(r.validations)
+		rt, err := r.nextChunk(user)
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		if rt == nil {
+			continue
+		}
+		select {
+		case inflight <- struct{}{}:
+		case <-done:
+			break read
+		}
+		job := &chunkJob{
+			rt:     *rt,
+			chunk:  append([]byte(nil), r.chunk...),
+			rows:   append([]rowOffset(nil), r.rows...),
+			valid:  append([]Validation(nil), r.validations[nvalid:]...),
+			result: make(chan batchResult, 1),
+		}
+		job.rt.columns = append([]*readColumn(nil), rt.columns...)
+		r.rows = r.rows[:0]
+		pipe(rt.ID) <- job.result
+		jobs <- job
+	}
+	close(jobs)
+	for _, p := range pipes {
+		close(p)
+	}
+	wg.Wait()
+	deliver.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return readErr
+}
+
+// decodeBatch decodes the rows of a chunk.
+func (r *Reader) decodeBatch(job *chunkJob) (*Batch, error) {
+	rt := &job.rt
+	b := &Batch{
+		Table:       rt.Table,
+		Columns:     rt.Columns,
+		Version:     rt.version,
+		Validations: job.valid,
+	}
+	for i, o := range job.rows {
+		if !isRowKind(o.Type) {
+			continue
+		}
+		end := int64(len(job.chunk))
+		if i+1 < len(job.rows) {
+			end = job.rows[i+1].Offset
+		}
+		row := job.chunk[o.Offset:end]
+		values, err := r.decodeRow(rt, row, nil)
+		if err != nil {
+			return nil, err
+		}
+		kind := RowKind(o.Type)
+		var changed []bool
+		if kind != RowData {
+			changed = rowChanged(row, len(rt.columns))
+		}
+		b.Kinds = append(b.Kinds, kind)
+		b.IDs = append(b.IDs, o.ID)
+		b.Rows = append(b.Rows, values)
+		b.Changed = append(b.Changed, changed)
+	}
+	return b, nil
+}
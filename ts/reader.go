@@ -5,19 +5,796 @@
 package ts
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"reflect"
+	"sort"
 )
 
+// Reader decodes a ts stream written by a Writer.
+//
+// Control tables are read as they appear in the stream and are used to
+// decode the tables that follow. By default only rows of non-control
+// tables are returned from Next.
 type Reader struct {
-	table map[int64][]chunk
+	r   *bufio.Reader
+	err error
+
+	started     bool
+	done        bool
+	showControl bool
+
+	field  map[Type]FieldCoder
+	table  map[int64]*readTable
+	column map[int64]*readColumn // control/column rows by ID.
+
+	tags        map[Tag]string
+	targets     map[string][]Col // Expected columns by table name.
+	src         io.Reader        // Stream passed to NewReader.
+	index       *keyIndex        // Key index, loaded by Lookup.
+	validations []Validation
+
+	group      *bytes.Reader // Chunks of the group being read.
+	groupCount int64         // Number of groups read.
+	chunkGroup int64         // Group of the current chunk, zero if none.
+
+	chunk    []byte
+	rt       *readTable
+	rows     []rowOffset
+	rowIndex int
+	row      []byte
+}
+
+type readColumn struct {
+	ID    int64
+	Table int64
+	Col
+
+	// FixedByteSize is the size of the column value within the row,
+	// zero for variable length fields.
+	FixedByteSize int64
+}
+
+type readTable struct {
+	tableInfo
+	columns  []*readColumn // Ordered by sort order.
+	rowID    int64         // ID of the last row read.
+	version  [32]byte      // Version of the columns.
+	versions map[[32]byte]*versionColumns
+	mapping  *colMap // Expected columns, nil if the stream columns are used.
 }
 
+type rowOffset struct {
+	Type   byte
+	Offset int64
+	ID     int64 // Row ID, zero for validation rows.
+}
+
+// NewReader returns a new Reader that reads a ts stream from r.
 func NewReader(r io.Reader) *Reader {
+	rr := &Reader{
+		src:    r,
+		r:      bufio.NewReader(r),
+		field:  make(map[Type]FieldCoder, 10),
+		table:  make(map[int64]*readTable, 10),
+		column: make(map[int64]*readColumn, 10),
+		tags:   make(map[Tag]string, 10),
+	}
+	for _, ft := range builtinFieldTypes {
+		rr.field[ft.Type] = ft.Coder
+	}
+	for _, cd := range controlDefs {
+		rt := &readTable{
+			tableInfo: tableInfo{
+				ID:    cd.ID,
+				Table: cd.Table,
+			},
+		}
+		for i, c := range cd.Columns {
+			c.SortOrder = int64(i + 1)
+			rt.columns = append(rt.columns, &readColumn{
+				Table:         cd.ID,
+				Col:           c,
+				FixedByteSize: fixedByteSize(rr.field[c.Type].BitSize()),
+			})
+		}
+		rt.update()
+		rr.table[cd.ID] = rt
+	}
+	return rr
+}
+
+// update rebuilds the column list after a column has changed.
+func (rt *readTable) update() {
+	rt.mapping = nil
+	sort.SliceStable(rt.columns, func(i, j int) bool {
+		return rt.columns[i].SortOrder < rt.columns[j].SortOrder
+	})
+	rt.Columns = make([]Col, len(rt.columns))
+	rt.ColumnByName = make(map[string]*Col, len(rt.columns))
+	for i, rc := range rt.columns {
+		rt.Columns[i] = rc.Col
+		rt.ColumnByName[rc.Name] = &rt.Columns[i]
+	}
+}
+
+func isControl(tid int64) bool {
+	for _, cd := range controlDefs {
+		if cd.ID == tid {
+			return true
+		}
+	}
+	return false
+}
+
+// ShowControl sets whether rows of the control tables are returned from Next.
+func (r *Reader) ShowControl(show bool) {
+	r.showControl = show
+}
+
+// Err returns the first error encountered while reading.
+// Reaching the end of the stream is not an error.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Next advances to the next row. It returns false at the end of the stream
+// or after an error.
+func (r *Reader) Next() bool {
+	return r.advance(func(rt *readTable) bool {
+		return r.showControl || !isControl(rt.ID)
+	})
+}
+
+// Tables returns the definitions of the tables read so far, ordered by table ID.
+// Control tables are included if ShowControl is set.
+func (r *Reader) Tables() []TableDef {
+	ids := make([]int64, 0, len(r.table))
+	for id := range r.table {
+		if isControl(id) && !r.showControl {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	defs := make([]TableDef, len(ids))
+	for i, id := range ids {
+		rt := r.table[id]
+		defs[i].ID = rt.ID
+		defs[i].Table = rt.Table
+		defs[i].Columns = make([]Col, len(rt.Columns))
+		copy(defs[i].Columns, rt.Columns)
+	}
+	return defs
+}
+
+// Table returns the table of the current row.
+func (r *Reader) Table() Table {
+	if r.rt == nil {
+		return Table{}
+	}
+	return r.rt.Table
+}
+
+// Columns returns the columns of the current row's table.
+func (r *Reader) Columns() []Col {
+	if r.rt == nil {
+		return nil
+	}
+	cols := make([]Col, len(r.rt.view()))
+	copy(cols, r.rt.view())
+	return cols
+}
+
+// Values decodes all the values of the current row.
+func (r *Reader) Values() ([]interface{}, error) {
+	if r.rt == nil {
+		return nil, errors.New("ts: no current row")
+	}
+	return r.viewRow(r.rt, r.row, nil)
+}
+
+// Scan decodes the current row into the values pointed to by dest.
+// The number of values in dest must match the number of columns.
+func (r *Reader) Scan(dest ...interface{}) error {
+	values, err := r.Values()
+	if err != nil {
+		return err
+	}
+	return scanValues(r.rt.view(), values, dest)
+}
+
+// Cursor returns a Cursor over the rows of the named table.
+// If columns are listed, only those columns are decoded, in the given order.
+// Each column may be listed once.
+//
+// A Cursor shares the position of the Reader. Advancing the Cursor skips
+// the rows of other tables.
+func (r *Reader) Cursor(table string, columns ...string) *Cursor {
+	return &Cursor{
+		r:     r,
+		table: table,
+		col:   columns,
+		sel:   make(map[int64]cursorSel, 1),
+	}
+}
+
+// advance moves to the next row in a table that match reports as wanted.
+// Chunks of other tables are skipped without decoding the rows.
+// Control tables are always applied.
+func (r *Reader) advance(match func(rt *readTable) bool) bool {
+	if r.err != nil || r.done {
+		return false
+	}
+	for {
+		if r.rt != nil && r.rowIndex+1 < len(r.rows) {
+			r.rowIndex++
+			r.setRow()
+			if !isRowKind(r.rows[r.rowIndex].Type) {
+				continue
+			}
+			return true
+		}
+		r.rt = nil
+		r.rows = r.rows[:0]
+		r.rowIndex = -1
+
+		rt, err := r.nextChunk(match)
+		if err != nil {
+			if err == io.EOF {
+				r.done = true
+			} else {
+				r.err = err
+			}
+			return false
+		}
+		if rt == nil {
+			continue
+		}
+		r.rt = rt
+	}
+}
+
+func (r *Reader) setRow() {
+	start := r.rows[r.rowIndex].Offset
+	end := int64(len(r.chunk))
+	if r.rowIndex+1 < len(r.rows) {
+		end = r.rows[r.rowIndex+1].Offset
+	}
+	r.row = r.chunk[start:end]
+}
+
+// readError returns the error for a stream that ends with err before the
+// end marker. The underlying reader may return ErrStreamCancel to cancel
+// the stream, any other error is an unexpected end of the stream.
+func readError(err error) error {
+	if err == ErrStreamCancel {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// nextChunk reads the next chunk in the stream. If the chunk is for
+// a control table, the control rows are applied. If match reports the chunk
+// table is wanted the row offsets are read and the table is returned,
+// otherwise nil is returned.
+func (r *Reader) nextChunk(match func(rt *readTable) bool) (*readTable, error) {
+	if !r.started {
+		r.started = true
+		head := make([]byte, len(fileHeader))
+		if _, err := io.ReadFull(r.r, head); err != nil {
+			if err == ErrStreamCancel {
+				return nil, err
+			}
+			return nil, fmt.Errorf("ts: unable to read header: %v", err)
+		}
+		if !bytes.Equal(head, fileHeader) {
+			return nil, errors.New("ts: invalid file header")
+		}
+	}
+	var src io.Reader = r.r
+	r.chunkGroup = 0
+	if r.group != nil {
+		if r.group.Len() > 0 {
+			src = r.group
+			r.chunkGroup = r.groupCount
+		} else {
+			r.group = nil
+		}
+	}
+	marker := make([]byte, 2)
+	if _, err := io.ReadFull(src, marker); err != nil {
+		return nil, readError(err)
+	}
+	switch {
+	default:
+		return nil, fmt.Errorf("ts: unknown marker %v", marker)
+	case bytes.Equal(marker, fileEOF):
+		return nil, io.EOF
+	case bytes.Equal(marker, fileCancel):
+		return nil, ErrStreamCancel
+	case bytes.Equal(marker, markerIndex):
+		return nil, skipIndex(src)
+	case bytes.Equal(marker, markerGroupBegin):
+		group, err := r.readGroup()
+		if err != nil {
+			return nil, err
+		}
+		r.group = group
+		r.groupCount++
+		return nil, nil
+	case bytes.Equal(marker, markerGroupCommit):
+		return nil, errors.New("ts: commit without a group")
+	case bytes.Equal(marker, markerChunk):
+	}
+
+	var size int64
+	if err := binary.Read(src, binary.LittleEndian, &size); err != nil {
+		return nil, readError(err)
+	}
+	if size < 16 {
+		return nil, fmt.Errorf("ts: invalid chunk size %d", size)
+	}
+	if int64(cap(r.chunk)) < size {
+		r.chunk = make([]byte, size)
+	}
+	r.chunk = r.chunk[:size]
+	if _, err := io.ReadFull(src, r.chunk); err != nil {
+		return nil, readError(err)
+	}
+	tid := int64(binary.LittleEndian.Uint64(r.chunk[0:]))
+	rowCount := int64(binary.LittleEndian.Uint64(r.chunk[8:]))
+	rt, ok := r.table[tid]
+	if !ok {
+		return nil, fmt.Errorf("ts: chunk for unknown table %d", tid)
+	}
+	if rowCount < 0 || 16+rowCount*9 > size {
+		return nil, fmt.Errorf("ts: invalid row count %d for table %q", rowCount, rt.Name)
+	}
+	// The row offsets of every chunk are read to number the rows
+	// and to collect the validation rows.
+	r.rows = r.rows[:0]
+	for i := int64(0); i < rowCount; i++ {
+		at := 16 + i*9
+		o := rowOffset{
+			Type:   r.chunk[at],
+			Offset: int64(binary.LittleEndian.Uint64(r.chunk[at+1:])),
+		}
+		if o.Offset < 16+rowCount*9 || o.Offset > size {
+			return nil, fmt.Errorf("ts: invalid row offset %d for table %q", o.Offset, rt.Name)
+		}
+		if isRowKind(o.Type) {
+			rt.rowID++
+			o.ID = rt.rowID
+		}
+		r.rows = append(r.rows, o)
+	}
+	for i, o := range r.rows {
+		if RowKind(o.Type) != RowValidation {
+			continue
+		}
+		end := size
+		if i+1 < len(r.rows) {
+			end = r.rows[i+1].Offset
+		}
+		v, err := decodeValidation(r.chunk[o.Offset:end])
+		if err != nil {
+			return nil, err
+		}
+		v.Table = rt.Name
+		r.validations = append(r.validations, v)
+	}
+	if err := r.chunkVersion(rt); err != nil {
+		return nil, err
+	}
+	if isControl(tid) {
+		if err := r.applyControl(rt); err != nil {
+			return nil, err
+		}
+	}
+	if !match(rt) {
+		return nil, nil
+	}
+	if err := r.mapTable(rt); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// applyControl reads each row of the current control chunk and updates
+// the table definitions.
+func (r *Reader) applyControl(rt *readTable) error {
+	for i := range r.rows {
+		if r.rows[i].Type != markerRow[1] {
+			continue
+		}
+		r.rowIndex = i
+		r.setRow()
+		values, err := r.decodeRow(rt, r.row, nil)
+		if err != nil {
+			return err
+		}
+		v := func(name string) interface{} {
+			return values[rt.columnIndex(name)]
+		}
+		i64 := func(name string) int64 {
+			x, _ := v(name).(int64)
+			return x
+		}
+		str := func(name string) string {
+			x, _ := v(name).(string)
+			return x
+		}
+		boolean := func(name string) bool {
+			x, _ := v(name).(bool)
+			return x
+		}
+
+		switch rt.ID {
+		case controlTableID:
+			id := i64("id")
+			if isControl(id) {
+				continue
+			}
+			version, _ := v("version").([32]byte)
+			t, ok := r.table[id]
+			if !ok {
+				t = &readTable{tableInfo: tableInfo{ID: id}}
+				t.version = version
+				r.table[id] = t
+			}
+			if err := t.setVersion(version, true); err != nil {
+				return err
+			}
+			t.Name = str("name")
+			t.Comment = str("comment")
+			t.update()
+		case controlTagID:
+			r.tags[Tag(i64("id"))] = str("name")
+		case controlTableTagID:
+			t, ok := r.table[i64("table")]
+			if !ok || isControl(t.ID) {
+				continue
+			}
+			t.Tags = append(t.Tags, Tag(i64("tag")))
+		case controlColumnID:
+			tid := i64("table")
+			if isControl(tid) {
+				continue
+			}
+			t, ok := r.table[tid]
+			if !ok {
+				return fmt.Errorf("ts: column %q for unknown table %d", str("name"), tid)
+			}
+			rc := &readColumn{
+				ID:    i64("id"),
+				Table: tid,
+				Col: Col{
+					Name:      str("name"),
+					Type:      Type(i64("fieldtype")),
+					Link:      i64("link"),
+					Key:       boolean("key"),
+					Nullable:  boolean("nullable"),
+					Length:    i64("length"),
+					SortOrder: i64("sort_order"),
+					Default:   v("default"),
+					Comment:   str("comment"),
+				},
+				FixedByteSize: fixedByteSize(i64("fixed_bit_size")),
+			}
+			if _, ok := r.field[rc.Type]; !ok {
+				return fmt.Errorf("ts: unknown type %d for %s.%s", rc.Type, t.Name, rc.Name)
+			}
+			r.column[rc.ID] = rc
+			t.columns = append(t.columns, rc)
+			t.update()
+		case controlColumnTagID:
+			rc, ok := r.column[i64("column")]
+			if !ok {
+				continue
+			}
+			rc.Tags = append(rc.Tags, Tag(i64("tag")))
+			r.table[rc.Table].update()
+		}
+	}
+	r.rowIndex = -1
 	return nil
 }
 
-// indexTable reads through the entire data structure, seeking each
-// new token until the EOF is reached.
-func (r *Reader) indexTable() error {
+// zeroValue returns the value read for an empty column with a Zero default.
+func zeroValue(t Type) interface{} {
+	switch t {
+	case Hash:
+		return [hashSizeBytes]byte{}
+	case Int64:
+		return int64(0)
+	case Bool:
+		return false
+	case String:
+		return ""
+	case Bytes:
+		return []byte{}
+	}
+	return Zero
+}
+
+// emptyValue returns the value read for a column without a value.
+func emptyValue(c *Col) interface{} {
+	switch c.Default {
+	case nil:
+		return nil
+	case Zero:
+		return zeroValue(c.Type)
+	}
+	return c.Default
+}
+
+// decodeRow decodes the columns of row. If sel is nil all columns are returned
+// in column order. Otherwise sel holds the column index of each value to return.
+//
+// Columns that are not selected are skipped using the fixed size of the
+// column or the value size prefix, without being decoded.
+//
+// Empty columns of a data row return the column default. Columns not set
+// by an update or delete row are nil.
+func (r *Reader) decodeRow(rt *readTable, row []byte, sel []int) ([]interface{}, error) {
+	ncol := len(rt.columns)
+	maskLen := (ncol + 7) / 8
+	if len(row) < 2+maskLen {
+		return nil, fmt.Errorf("ts: short row for table %q", rt.Name)
+	}
+	kind := RowKind(row[1])
+	mask := row[2 : 2+maskLen]
+	pos := int64(2 + maskLen)
+	if kind == RowUpdate {
+		pos += int64(maskLen)
+		if int64(len(row)) < pos {
+			return nil, fmt.Errorf("ts: short row for table %q", rt.Name)
+		}
+	}
+
+	var want []int // Output index for each column, -1 if not wanted.
+	var out []interface{}
+	remain := ncol
+	if sel == nil {
+		out = make([]interface{}, ncol)
+	} else {
+		out = make([]interface{}, len(sel))
+		want = make([]int, ncol)
+		for i := range want {
+			want[i] = -1
+		}
+		for oi, ci := range sel {
+			want[ci] = oi
+		}
+		remain = len(sel)
+	}
+
+	for i, rc := range rt.columns {
+		if remain == 0 {
+			break
+		}
+		oi := i
+		if want != nil {
+			oi = want[i]
+		}
+		if mask[i/8]&(1<<uint(i%8)) == 0 {
+			if oi >= 0 {
+				if kind == RowData {
+					out[oi] = emptyValue(&rc.Col)
+				}
+				remain--
+			}
+			continue
+		}
+		size := rc.FixedByteSize
+		if size == 0 {
+			if pos+8 > int64(len(row)) {
+				return nil, fmt.Errorf("ts: short row for %s.%s", rt.Name, rc.Name)
+			}
+			size = int64(binary.LittleEndian.Uint64(row[pos:]))
+			pos += 8
+		}
+		if size < 0 || pos+size > int64(len(row)) {
+			return nil, fmt.Errorf("ts: short row for %s.%s", rt.Name, rc.Name)
+		}
+		if oi >= 0 {
+			v, err := r.field[rc.Type].Decode(&rc.Col, row[pos:pos+size])
+			if err != nil {
+				return nil, err
+			}
+			out[oi] = v
+			remain--
+		}
+		pos += size
+	}
+	return out, nil
+}
+
+// scanValues assigns values to the pointers in dest.
+func scanValues(cols []Col, values []interface{}, dest []interface{}) error {
+	if len(dest) != len(values) {
+		return fmt.Errorf("ts: expected %d destination arguments in Scan, got %d", len(values), len(dest))
+	}
+	for i, d := range dest {
+		if err := assignValue(d, values[i]); err != nil {
+			return fmt.Errorf("ts: scan column %q: %v", cols[i].Name, err)
+		}
+	}
 	return nil
 }
+
+// assignValue stores v in the value pointed to by dest.
+// A nil value may be stored in a pointer, slice or interface.
+// A pointer destination is allocated if needed.
+func assignValue(dest interface{}, v interface{}) error {
+	dp := reflect.ValueOf(dest)
+	if dp.Kind() != reflect.Ptr || dp.IsNil() {
+		return fmt.Errorf("destination not a pointer: %T", dest)
+	}
+	return assignReflect(dp.Elem(), v)
+}
+
+func assignReflect(dv reflect.Value, v interface{}) error {
+	if v == nil {
+		switch dv.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			dv.Set(reflect.Zero(dv.Type()))
+			return nil
+		}
+		return fmt.Errorf("cannot store null into %s", dv.Type())
+	}
+	rv := reflect.ValueOf(v)
+	if dv.Kind() == reflect.Ptr && !rv.Type().AssignableTo(dv.Type()) {
+		nv := reflect.New(dv.Type().Elem())
+		if err := assignReflect(nv.Elem(), v); err != nil {
+			return err
+		}
+		dv.Set(nv)
+		return nil
+	}
+	if rv.Type().AssignableTo(dv.Type()) {
+		dv.Set(rv)
+		return nil
+	}
+	switch dv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Kind() == reflect.Int64 {
+			x := rv.Int()
+			if dv.OverflowInt(x) {
+				return fmt.Errorf("value %d overflows %s", x, dv.Type())
+			}
+			dv.SetInt(x)
+			return nil
+		}
+	case reflect.String:
+		if rv.Kind() == reflect.String {
+			dv.SetString(rv.String())
+			return nil
+		}
+	case reflect.Bool:
+		if rv.Kind() == reflect.Bool {
+			dv.SetBool(rv.Bool())
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot store %T into %s", v, dv.Type())
+}
+
+// Cursor reads the rows of a single table, optionally decoding only a subset
+// of the columns. A Cursor is created with Reader.Cursor.
+type Cursor struct {
+	r     *Reader
+	err   error
+	table string
+	col   []string
+
+	sel map[int64]cursorSel // Selected column indexes by table ID.
+}
+
+// cursorSel holds the selected column indexes for the columns of a table
+// version and mapping.
+type cursorSel struct {
+	version [32]byte
+	mapping *colMap
+	index   []int
+}
+
+// Next advances to the next row of the table.
+func (c *Cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	ok := c.r.advance(func(rt *readTable) bool {
+		return rt.Name == c.table
+	})
+	if !ok {
+		return false
+	}
+	if _, err := c.selected(c.r.rt); err != nil {
+		c.err = err
+		return false
+	}
+	return true
+}
+
+// Err returns the first error encountered by the Cursor or the Reader.
+func (c *Cursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.r.Err()
+}
+
+// selected returns the column indexes to decode for the table.
+func (c *Cursor) selected(rt *readTable) ([]int, error) {
+	if len(c.col) == 0 {
+		return nil, nil
+	}
+	if s, ok := c.sel[rt.ID]; ok && s.version == rt.version && s.mapping == rt.mapping {
+		return s.index, nil
+	}
+	sel := make([]int, len(c.col))
+	seen := make(map[string]bool, len(c.col))
+	var invalid []string
+	for i, name := range c.col {
+		if seen[name] {
+			return nil, fmt.Errorf("ts: column %q selected twice for table %q", name, rt.Name)
+		}
+		seen[name] = true
+		sel[i] = rt.viewIndex(name)
+		if sel[i] < 0 {
+			invalid = append(invalid, name)
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("ts: invalid column names for table %q: %q", rt.Name, invalid)
+	}
+	c.sel[rt.ID] = cursorSel{version: rt.version, mapping: rt.mapping, index: sel}
+	return sel, nil
+}
+
+// Columns returns the columns the Cursor decodes for the current row.
+func (c *Cursor) Columns() []Col {
+	rt := c.r.rt
+	if rt == nil {
+		return nil
+	}
+	sel, _ := c.selected(rt)
+	if sel == nil {
+		return c.r.Columns()
+	}
+	cols := make([]Col, len(sel))
+	for i, ci := range sel {
+		cols[i] = rt.view()[ci]
+	}
+	return cols
+}
+
+// Values decodes the selected values of the current row.
+func (c *Cursor) Values() ([]interface{}, error) {
+	rt := c.r.rt
+	if rt == nil {
+		return nil, errors.New("ts: no current row")
+	}
+	sel, err := c.selected(rt)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.viewRow(rt, c.r.row, sel)
+}
+
+// Scan decodes the selected values of the current row into dest.
+func (c *Cursor) Scan(dest ...interface{}) error {
+	values, err := c.Values()
+	if err != nil {
+		return err
+	}
+	return scanValues(c.Columns(), values, dest)
+}
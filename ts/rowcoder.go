@@ -0,0 +1,440 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// RowEncoder encodes a single row one column at a time, in column order.
+// It produces the same row as Insert without converting each value
+// through an interface. It is intended for generated code.
+//
+// Each column must be given exactly one value before calling Done.
+type RowEncoder struct {
+	w    *Writer
+	ti   *tableInfo
+	tid  int64
+	col  int
+	mask []byte
+	data []byte
+	err  error
+
+	key    int64 // Value of the last Int64 key column.
+	hasKey bool
+
+	// Key and link values, kept for the integrity checks of the writer.
+	names  []string
+	values []interface{}
+}
+
+// EncodeRow starts a new row in table t. The TableRef column selection
+// is ignored; all columns of the table are encoded.
+func (w *Writer) EncodeRow(t TableRef) *RowEncoder {
+	e := &w.rowEncoder
+	*e = RowEncoder{
+		w:      w,
+		tid:    t.id,
+		mask:   e.mask[:0],
+		data:   e.data[:0],
+		names:  e.names[:0],
+		values: e.values[:0],
+	}
+	if w.err != nil {
+		e.err = w.err
+		return e
+	}
+	ti, ok := w.table[t.id]
+	if !ok {
+		e.err = errors.New("ts: unknown table")
+		return e
+	}
+	e.ti = ti
+	for i := 0; i < (len(ti.Columns)+7)/8; i++ {
+		e.mask = append(e.mask, 0)
+	}
+	return e
+}
+
+// next returns the next column if it has type t.
+func (e *RowEncoder) next(t Type) *Col {
+	if e.err != nil {
+		return nil
+	}
+	if e.col >= len(e.ti.Columns) {
+		e.err = fmt.Errorf("ts: too many values for table %q", e.ti.Name)
+		return nil
+	}
+	c := &e.ti.Columns[e.col]
+	if c.Type != t {
+		e.err = fmt.Errorf("ts: column %s.%s is %v, not %v", e.ti.Name, c.Name, c.Type, t)
+		return nil
+	}
+	e.mask[e.col/8] |= 1 << uint(e.col%8)
+	e.col++
+	return c
+}
+
+// record keeps the value of a key or link column for checkRow.
+func (e *RowEncoder) record(c *Col, v interface{}) {
+	if (c.Key || c.Link != 0) && e.w.trackKeys(e.tid) {
+		e.names = append(e.names, c.Name)
+		e.values = append(e.values, v)
+	}
+}
+
+func (e *RowEncoder) putSize(n int) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(n))
+	e.data = append(e.data, b[:]...)
+}
+
+// Null leaves the next column without a value.
+func (e *RowEncoder) Null() {
+	if e.err != nil {
+		return
+	}
+	if e.col >= len(e.ti.Columns) {
+		e.err = fmt.Errorf("ts: too many values for table %q", e.ti.Name)
+		return
+	}
+	c := &e.ti.Columns[e.col]
+	if !c.Nullable && c.Default == nil {
+		e.err = fmt.Errorf("ts: missing value for %s.%s", e.ti.Name, c.Name)
+		return
+	}
+	e.col++
+}
+
+// Hash encodes the next column as a Hash.
+func (e *RowEncoder) Hash(v [32]byte) {
+	c := e.next(Hash)
+	if c == nil {
+		return
+	}
+	e.record(c, v)
+	e.data = append(e.data, v[:]...)
+}
+
+// Int64 encodes the next column as an Int64.
+func (e *RowEncoder) Int64(v int64) {
+	c := e.next(Int64)
+	if c == nil {
+		return
+	}
+	if c.Key {
+		e.key, e.hasKey = v, true
+	}
+	e.record(c, v)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	e.data = append(e.data, b[:]...)
+}
+
+// Bool encodes the next column as a Bool.
+func (e *RowEncoder) Bool(v bool) {
+	c := e.next(Bool)
+	if c == nil {
+		return
+	}
+	e.record(c, v)
+	if v {
+		e.data = append(e.data, 1)
+	} else {
+		e.data = append(e.data, 0)
+	}
+}
+
+// String encodes the next column as a String.
+func (e *RowEncoder) String(v string) {
+	c := e.next(String)
+	if c == nil {
+		return
+	}
+	if err := checkString(c, v); err != nil {
+		e.err = fmt.Errorf("%v in %s.%s", err, e.ti.Name, c.Name)
+		return
+	}
+	e.record(c, v)
+	e.putSize(len(v))
+	e.data = append(e.data, v...)
+}
+
+// Bytes encodes the next column as Bytes. A nil slice encodes no value.
+func (e *RowEncoder) Bytes(v []byte) {
+	if v == nil {
+		e.Null()
+		return
+	}
+	c := e.next(Bytes)
+	if c == nil {
+		return
+	}
+	if c.Length > 0 && int64(len(v)) > c.Length {
+		e.err = fmt.Errorf("ts: value for %q contains %d bytes, max allowed is %d", c.Name, len(v), c.Length)
+		return
+	}
+	e.record(c, v)
+	e.putSize(len(v))
+	e.data = append(e.data, v...)
+}
+
+// Any encodes the next column as Any. A nil value encodes no value.
+func (e *RowEncoder) Any(v interface{}) {
+	if v == nil {
+		e.Null()
+		return
+	}
+	c := e.next(Any)
+	if c == nil {
+		return
+	}
+	buf, err := e.w.field[Any].Encode(c, nil, v)
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.record(c, v)
+	e.putSize(len(buf))
+	e.data = append(e.data, buf...)
+}
+
+// Done adds the encoded row to the table. A writer that checks integrity
+// checks the row as Insert does.
+func (e *RowEncoder) Done() RowRef {
+	w := e.w
+	if w.err != nil {
+		return errRow
+	}
+	if e.err == nil && e.col != len(e.ti.Columns) {
+		e.err = fmt.Errorf("ts: expected %d values, got %d values", len(e.ti.Columns), e.col)
+	}
+	if e.err == nil {
+		e.err = w.checkRow(e.ti, RowData, e.names, e.values)
+	}
+	if e.err != nil {
+		w.err = e.err
+		return errRow
+	}
+	row := make([]byte, 0, len(markerRow)+len(e.mask)+len(e.data))
+	row = append(row, markerRow...)
+	row = append(row, e.mask...)
+	row = append(row, e.data...)
+	w.rowBuffer[e.tid] = append(w.rowBuffer[e.tid], row)
+	if e.hasKey {
+		if ic := e.ti.idColumn(); ic >= 0 {
+			return w.rowRef(e.ti, RowData, []string{e.ti.Columns[ic].Name}, []interface{}{e.key})
+		}
+	}
+	return w.rowRef(e.ti, RowData, nil, nil)
+}
+
+// RowDecoder decodes the current row one column at a time, in column order.
+// It is intended for generated code.
+//
+// Each method reports whether the column has a value. A column without
+// a value but with a Default returns the default.
+type RowDecoder struct {
+	rt   *readTable
+	row  []byte
+	mask []byte
+	pos  int64
+	col  int
+	err  error
+}
+
+// DecodeRow returns a decoder for all the columns of the current row.
+func (r *Reader) DecodeRow() *RowDecoder {
+	d := &RowDecoder{
+		rt:  r.rt,
+		row: r.row,
+	}
+	if r.rt == nil {
+		d.err = errors.New("ts: no current row")
+		return d
+	}
+	if r.rt.mapping != nil {
+		d.err = fmt.Errorf("ts: cannot decode table %q read with expected columns", r.rt.Name)
+		return d
+	}
+	if k := r.Kind(); k != RowData {
+		d.err = fmt.Errorf("ts: cannot decode %v row of table %q", k, r.rt.Name)
+		return d
+	}
+	maskLen := (len(r.rt.columns) + 7) / 8
+	if len(r.row) < 2+maskLen {
+		d.err = fmt.Errorf("ts: short row for table %q", r.rt.Name)
+		return d
+	}
+	d.mask = r.row[2 : 2+maskLen]
+	d.pos = int64(2 + maskLen)
+	return d
+}
+
+// DecodeRow returns a decoder for all the columns of the current row.
+// The column selection of the Cursor is ignored.
+func (c *Cursor) DecodeRow() *RowDecoder {
+	return c.r.DecodeRow()
+}
+
+// Err returns the first error encountered while decoding.
+func (d *RowDecoder) Err() error {
+	return d.err
+}
+
+// Match sets an error if the table columns are not named names, in order.
+// Generated code calls Match before decoding the columns.
+func (d *RowDecoder) Match(names ...string) {
+	if d.err != nil {
+		return
+	}
+	if len(names) != len(d.rt.columns) {
+		d.err = fmt.Errorf("ts: table %q has %d columns, expected %d", d.rt.Name, len(d.rt.columns), len(names))
+		return
+	}
+	for i, rc := range d.rt.columns {
+		if rc.Name != names[i] {
+			d.err = fmt.Errorf("ts: table %q column %d is %q, expected %q", d.rt.Name, i, rc.Name, names[i])
+			return
+		}
+	}
+}
+
+// next returns the next column, its data and whether it has a value.
+func (d *RowDecoder) next(t Type) (*readColumn, []byte, bool) {
+	if d.err != nil {
+		return nil, nil, false
+	}
+	if d.col >= len(d.rt.columns) {
+		d.err = fmt.Errorf("ts: too many columns read from table %q", d.rt.Name)
+		return nil, nil, false
+	}
+	i := d.col
+	rc := d.rt.columns[i]
+	d.col++
+	if rc.Type != t {
+		d.err = fmt.Errorf("ts: column %s.%s is %v, not %v", d.rt.Name, rc.Name, rc.Type, t)
+		return nil, nil, false
+	}
+	if d.mask[i/8]&(1<<uint(i%8)) == 0 {
+		return rc, nil, false
+	}
+	size := rc.FixedByteSize
+	if size == 0 {
+		if d.pos+8 > int64(len(d.row)) {
+			d.err = fmt.Errorf("ts: short row for %s.%s", d.rt.Name, rc.Name)
+			return nil, nil, false
+		}
+		size = int64(binary.LittleEndian.Uint64(d.row[d.pos:]))
+		d.pos += 8
+	}
+	if size < 0 || d.pos+size > int64(len(d.row)) {
+		d.err = fmt.Errorf("ts: short row for %s.%s", d.rt.Name, rc.Name)
+		return nil, nil, false
+	}
+	data := d.row[d.pos : d.pos+size]
+	d.pos += size
+	return rc, data, true
+}
+
+// empty returns the default value of a column without a value.
+func (d *RowDecoder) empty(rc *readColumn) (interface{}, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	v := emptyValue(&rc.Col)
+	return v, v != nil
+}
+
+// Hash decodes the next column as a Hash.
+func (d *RowDecoder) Hash() (v [32]byte, ok bool) {
+	rc, data, ok := d.next(Hash)
+	if !ok {
+		x, ok := d.empty(rc)
+		v, _ = x.([32]byte)
+		return v, ok
+	}
+	if len(data) != hashSizeBytes {
+		d.err = fmt.Errorf("ts: hash for %q has %d bytes, expected %d", rc.Name, len(data), hashSizeBytes)
+		return v, false
+	}
+	copy(v[:], data)
+	return v, true
+}
+
+// Int64 decodes the next column as an Int64.
+func (d *RowDecoder) Int64() (int64, bool) {
+	rc, data, ok := d.next(Int64)
+	if !ok {
+		x, ok := d.empty(rc)
+		v, _ := x.(int64)
+		return v, ok
+	}
+	if len(data) != 8 {
+		d.err = fmt.Errorf("ts: int64 for %q has %d bytes, expected 8", rc.Name, len(data))
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(data)), true
+}
+
+// Bool decodes the next column as a Bool.
+func (d *RowDecoder) Bool() (bool, bool) {
+	rc, data, ok := d.next(Bool)
+	if !ok {
+		x, ok := d.empty(rc)
+		v, _ := x.(bool)
+		return v, ok
+	}
+	if len(data) != 1 {
+		d.err = fmt.Errorf("ts: bool for %q has %d bytes, expected 1", rc.Name, len(data))
+		return false, false
+	}
+	return data[0] != 0, true
+}
+
+// String decodes the next column as a String.
+func (d *RowDecoder) String() (string, bool) {
+	rc, data, ok := d.next(String)
+	if !ok {
+		x, ok := d.empty(rc)
+		v, _ := x.(string)
+		return v, ok
+	}
+	if !utf8.Valid(data) {
+		d.err = fmt.Errorf("ts: invalid utf8 string for %q", rc.Name)
+		return "", false
+	}
+	return string(data), true
+}
+
+// Bytes decodes the next column as Bytes.
+func (d *RowDecoder) Bytes() ([]byte, bool) {
+	rc, data, ok := d.next(Bytes)
+	if !ok {
+		x, ok := d.empty(rc)
+		v, _ := x.([]byte)
+		return v, ok
+	}
+	v := make([]byte, len(data))
+	copy(v, data)
+	return v, true
+}
+
+// Any decodes the next column as Any.
+func (d *RowDecoder) Any() (interface{}, bool) {
+	rc, data, ok := d.next(Any)
+	if !ok {
+		return d.empty(rc)
+	}
+	v, err := coderAny{}.Decode(&rc.Col, data)
+	if err != nil {
+		d.err = err
+		return nil, false
+	}
+	return v, true
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+)
+
+// ID returns the ID of the row. For a table with a single Int64 key column
+// the ID is the key. For a data row of a table without key columns the ID is
+// the position of the row in the table, starting at one. Otherwise the ID is
+// zero. The ID is -1 if the row was not written.
+//
+// A RowRef may be used as the value of a column that links to its table,
+// or as the key of a row in its own table.
+func (r RowRef) ID() int64 {
+	return r.id
+}
+
+// Table returns the ID of the table of the row.
+func (r RowRef) Table() int64 {
+	return r.table
+}
+
+// idColumn returns the index of the single Int64 key column, or -1 if the
+// table does not have one.
+func (ti *tableInfo) idColumn() int {
+	at := -1
+	for i, c := range ti.Columns {
+		if !c.Key {
+			continue
+		}
+		if at >= 0 || c.Type != Int64 {
+			return -1
+		}
+		at = i
+	}
+	return at
+}
+
+// resolveRefs replaces RowRef values with the ID of the row. The column
+// must link to the table of the row, or be the key of the table itself.
+// The values are copied if any are replaced.
+func (w *Writer) resolveRefs(ti *tableInfo, names []string, values []interface{}) ([]interface{}, error) {
+	copied := false
+	for i, v := range values {
+		ref, ok := v.(RowRef)
+		if !ok {
+			continue
+		}
+		if i >= len(names) {
+			break
+		}
+		c := ti.ColumnByName[names[i]]
+		if c == nil {
+			continue // Reported when the row is encoded.
+		}
+		switch {
+		case c.Link != 0 && c.Link == ref.table:
+		case c.Key && ref.table == ti.ID && ti.idColumn() >= 0:
+		default:
+			return nil, fmt.Errorf("ts: column %s.%s cannot hold a row of table %d", ti.Name, c.Name, ref.table)
+		}
+		if ref.id <= 0 {
+			return nil, fmt.Errorf("ts: column %s.%s given a row without an ID", ti.Name, c.Name)
+		}
+		if !copied {
+			values = append([]interface{}(nil), values...)
+			copied = true
+		}
+		values[i] = ref.id
+	}
+	return values, nil
+}
+
+// autoKey assigns the next row ID to the Int64 key column of a data row
+// if the key is not given or is nil.
+func (w *Writer) autoKey(ti *tableInfo, names []string, values []interface{}) ([]string, []interface{}) {
+	ic := ti.idColumn()
+	if ic < 0 {
+		return names, values
+	}
+	name := ti.Columns[ic].Name
+	for i, n := range names {
+		if n != name {
+			continue
+		}
+		if values[i] != nil {
+			return names, values
+		}
+		values = append([]interface{}(nil), values...)
+		values[i] = w.nextRowID(ti.ID)
+		return names, values
+	}
+	names = append(names[:len(names):len(names)], name)
+	values = append(values[:len(values):len(values)], w.nextRowID(ti.ID))
+	return names, values
+}
+
+// rowRef returns the RowRef of a row being written. Row IDs assigned to
+// later rows are kept greater than the keys already written.
+func (w *Writer) rowRef(ti *tableInfo, kind RowKind, names []string, values []interface{}) RowRef {
+	if ic := ti.idColumn(); ic >= 0 {
+		name := ti.Columns[ic].Name
+		for i, n := range names {
+			if n != name {
+				continue
+			}
+			id, ok := keyValue(values[i]).(int64)
+			if !ok {
+				break
+			}
+			if kind == RowData && w.rowID[ti.ID] < id {
+				w.rowID[ti.ID] = id
+			}
+			return RowRef{table: ti.ID, id: id}
+		}
+	}
+	if kind != RowData || len(ti.keyColumns()) > 0 {
+		return RowRef{table: ti.ID}
+	}
+	return RowRef{table: ti.ID, id: w.nextRowID(ti.ID)}
+}
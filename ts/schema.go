@@ -0,0 +1,211 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+)
+
+// Expect sets the columns the reader returns for the named table,
+// regardless of the columns the stream was written with.
+// Stream columns are matched to cols by name:
+//
+//   - A column in cols that is not in the stream is read as its Default,
+//     or as null if it is Nullable. It is an error if it has neither.
+//   - A stream column not in cols is ignored.
+//   - A stream column is widened to the type of the matching column:
+//     bool to int64, string or hash to bytes, and any type to any.
+//     A length may only grow. A nullable column may only be read as
+//     a column that is also nullable or has a default.
+//
+// Any other difference is an error when the first row of the table is read.
+// Values, Scan, ScanStruct, Changed, Columns and Cursors use cols.
+// Tables still returns the columns of the stream.
+func (r *Reader) Expect(table string, cols ...Col) {
+	if r.targets == nil {
+		r.targets = make(map[string][]Col)
+	}
+	r.targets[table] = cols
+	for _, rt := range r.table {
+		if rt.Name == table {
+			rt.mapping = nil
+		}
+	}
+}
+
+// colMap maps the columns of a stream table to the expected columns.
+type colMap struct {
+	cols   []Col
+	byName map[string]int
+	from   []int                           // Stream column index for each column, -1 if added.
+	conv   []func(interface{}) interface{} // Conversion for each column, nil if none.
+}
+
+// mapTable sets the column mapping of rt if the reader expects other columns.
+func (r *Reader) mapTable(rt *readTable) error {
+	cols, ok := r.targets[rt.Name]
+	if !ok || rt.mapping != nil {
+		return nil
+	}
+	m := &colMap{
+		cols:   cols,
+		byName: make(map[string]int, len(cols)),
+		from:   make([]int, len(cols)),
+		conv:   make([]func(interface{}) interface{}, len(cols)),
+	}
+	for i := range cols {
+		to := &cols[i]
+		m.byName[to.Name] = i
+		fi := rt.columnIndex(to.Name)
+		m.from[i] = fi
+		if fi < 0 {
+			if !to.Nullable && to.Default == nil {
+				return fmt.Errorf("ts: column %s.%s is not in the stream and has no default", rt.Name, to.Name)
+			}
+			continue
+		}
+		conv, err := widen(&rt.Columns[fi], to)
+		if err != nil {
+			return fmt.Errorf("ts: column %s.%s: %v", rt.Name, to.Name, err)
+		}
+		m.conv[i] = conv
+	}
+	rt.mapping = m
+	return nil
+}
+
+// widen returns the conversion of values of column from to column to,
+// or nil if the value does not change.
+func widen(from, to *Col) (func(interface{}) interface{}, error) {
+	if from.Nullable && !to.Nullable && to.Default == nil {
+		return nil, fmt.Errorf("nullable column cannot be read as not nullable without a default")
+	}
+	if from.Type == to.Type {
+		if to.Length != 0 && (from.Length == 0 || from.Length > to.Length) {
+			return nil, fmt.Errorf("length %d cannot be read as length %d", from.Length, to.Length)
+		}
+		return nil, nil
+	}
+	if to.Type == Any {
+		return nil, nil
+	}
+	if to.Length != 0 {
+		return nil, fmt.Errorf("%v cannot be read as %v with a length", from.Type, to.Type)
+	}
+	switch {
+	case from.Type == Bool && to.Type == Int64:
+		return func(v interface{}) interface{} {
+			switch v {
+			case true:
+				return int64(1)
+			case false:
+				return int64(0)
+			}
+			return v
+		}, nil
+	case from.Type == String && to.Type == Bytes:
+		return func(v interface{}) interface{} {
+			if s, ok := v.(string); ok {
+				return []byte(s)
+			}
+			return v
+		}, nil
+	case from.Type == Hash && to.Type == Bytes:
+		return func(v interface{}) interface{} {
+			if h, ok := v.([32]byte); ok {
+				return h[:]
+			}
+			return v
+		}, nil
+	}
+	return nil, fmt.Errorf("%v cannot be read as %v", from.Type, to.Type)
+}
+
+// view returns the columns rows of rt are returned with.
+func (rt *readTable) view() []Col {
+	if rt.mapping != nil {
+		return rt.mapping.cols
+	}
+	return rt.Columns
+}
+
+// viewIndex returns the index of the named column in the returned columns.
+func (rt *readTable) viewIndex(name string) int {
+	if rt.mapping == nil {
+		return rt.columnIndex(name)
+	}
+	if i, ok := rt.mapping.byName[name]; ok {
+		return i
+	}
+	return -1
+}
+
+// viewRow decodes the columns of row selected by sel, an index into the
+// returned columns. If sel is nil all returned columns are decoded.
+func (r *Reader) viewRow(rt *readTable, row []byte, sel []int) ([]interface{}, error) {
+	m := rt.mapping
+	if m == nil {
+		return r.decodeRow(rt, row, sel)
+	}
+	if sel == nil {
+		sel = make([]int, len(m.cols))
+		for i := range sel {
+			sel[i] = i
+		}
+	}
+	from := make([]int, 0, len(sel))
+	for _, vi := range sel {
+		if fi := m.from[vi]; fi >= 0 {
+			from = append(from, fi)
+		}
+	}
+	values, err := r.decodeRow(rt, row, from)
+	if err != nil {
+		return nil, err
+	}
+	kind := RowKind(row[1])
+	out := make([]interface{}, len(sel))
+	for i, vi := range sel {
+		to := &m.cols[vi]
+		if m.from[vi] < 0 {
+			if kind == RowData {
+				out[i] = emptyValue(to)
+			}
+			continue
+		}
+		v := values[0]
+		values = values[1:]
+		if v == nil {
+			if kind == RowData && !to.Nullable {
+				v = emptyValue(to)
+			}
+			out[i] = v
+			continue
+		}
+		if conv := m.conv[vi]; conv != nil {
+			v = conv(v)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// viewChanged maps the changed flags of the stream columns to the
+// returned columns. Added columns are only set by data rows.
+func (rt *readTable) viewChanged(set []bool, kind RowKind) []bool {
+	m := rt.mapping
+	if m == nil {
+		return set
+	}
+	out := make([]bool, len(m.cols))
+	for i, fi := range m.from {
+		if fi < 0 {
+			out[i] = kind == RowData
+			continue
+		}
+		out[i] = set[fi]
+	}
+	return out
+}
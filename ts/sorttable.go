@@ -0,0 +1,297 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// SortedTagName is the name of the tag SortTable sets on a sorted table.
+const SortedTagName = "sorted"
+
+// defaultRunRows is the number of rows sorted in memory by default.
+const defaultRunRows = 100000
+
+// SortOptions controls how SortTable sorts a table.
+type SortOptions struct {
+	// RunRows is the number of rows sorted in memory at a time.
+	// If the table has more rows, sorted runs are written to temporary
+	// files and merged. If zero, 100000 rows are sorted at a time.
+	RunRows int
+
+	// Dir is the directory for temporary files. If empty, the default
+	// directory for temporary files is used.
+	Dir string
+
+	// KeyIndex writes a key index to out, see Writer.KeyIndex.
+	KeyIndex bool
+}
+
+// SortTable copies the stream in to out with the rows of the named
+// table sorted by its key columns. See SortOptions.SortTable.
+func SortTable(out io.Writer, in io.Reader, table string) error {
+	return SortOptions{}.SortTable(out, in, table)
+}
+
+// SortTable copies the stream in to out with the rows of the named
+// table sorted by its key columns, and tags the table with the tag named
+// SortedTagName. Rows with equal keys keep their order.
+//
+// The table must have key columns and only data rows. Its rows are written
+// after the rows of the other tables, which are copied as in Merge.
+func (o SortOptions) SortTable(out io.Writer, in io.Reader, table string) error {
+	runRows := o.RunRows
+	if runRows <= 0 {
+		runRows = defaultRunRows
+	}
+	m := &merger{
+		w:      NewWriter(out),
+		byName: make(map[string]*mergeTable),
+		ext: &extSort{
+			table:   table,
+			runRows: runRows,
+			dir:     o.Dir,
+		},
+	}
+	defer m.ext.close()
+	m.w.KeyIndex(o.KeyIndex)
+	if err := m.read(in); err != nil {
+		return err
+	}
+	mt, ok := m.byName[table]
+	if !ok {
+		return fmt.Errorf("ts: table %q not in stream", table)
+	}
+	if err := m.ext.write(m.w, mt.ref); err != nil {
+		return err
+	}
+	return m.w.Close()
+}
+
+// extSort sorts the rows of a table that may not fit in memory.
+type extSort struct {
+	table   string
+	runRows int
+	dir     string
+
+	cols []Col
+	key  []int
+	rows [][]interface{}
+	runs []*os.File
+}
+
+// define sets the columns of the table.
+func (s *extSort) define(cols []Col) error {
+	s.key = nil
+	s.cols = make([]Col, len(cols))
+	for i, c := range cols {
+		// Runs only hold the values.
+		c.Link = 0
+		c.Tags = nil
+		s.cols[i] = c
+		if c.Key {
+			s.key = append(s.key, i)
+		}
+	}
+	if len(s.key) == 0 {
+		return fmt.Errorf("ts: table %q has no key columns to sort by", s.table)
+	}
+	return nil
+}
+
+// redefine sets new columns of the table. Rows held in memory are mapped
+// to the new columns, runs are read with them. The key columns must not change.
+func (s *extSort) redefine(cols []Col) error {
+	prev := s.cols
+	if err := s.define(cols); err != nil {
+		return err
+	}
+	for i, row := range s.rows {
+		s.rows[i] = remapRow(row, prev, s.cols)
+	}
+	return nil
+}
+
+func (s *extSort) keyOf(row []interface{}) Key {
+	k := make(Key, len(s.key))
+	for i, ci := range s.key {
+		k[i] = row[ci]
+	}
+	return k
+}
+
+// add adds a row, writing a sorted run when enough rows are held.
+func (s *extSort) add(row []interface{}) error {
+	s.rows = append(s.rows, row)
+	if len(s.rows) < s.runRows {
+		return nil
+	}
+	return s.spill()
+}
+
+// sortRows sorts the rows held in memory.
+func (s *extSort) sortRows() {
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		return compareKey(s.keyOf(s.rows[i]), s.keyOf(s.rows[j])) < 0
+	})
+}
+
+// spill writes the rows held in memory to a temporary file as a sorted run.
+func (s *extSort) spill() error {
+	s.sortRows()
+	f, err := ioutil.TempFile(s.dir, "ts-sort-")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	w := NewWriter(f)
+	t := w.Define(Table{Name: s.table}, s.cols...)
+	for _, row := range s.rows {
+		w.Insert(t, row...)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	s.rows = nil
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// write writes the sorted rows to table t of w.
+func (s *extSort) write(w *Writer, t TableRef) error {
+	if len(s.runs) == 0 {
+		s.sortRows()
+		for _, row := range s.rows {
+			w.Insert(t, row...)
+		}
+		return w.Error()
+	}
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	h := &runHeap{}
+	for i, f := range s.runs {
+		rr := &run{index: i, r: NewReader(f)}
+		rr.r.Expect(s.table, s.cols...)
+		if err := rr.next(s); err != nil {
+			return err
+		}
+		if rr.row != nil {
+			h.list = append(h.list, rr)
+		}
+	}
+	heap.Init(h)
+	n := 0
+	for h.Len() > 0 {
+		rr := h.list[0]
+		w.Insert(t, rr.row...)
+		if err := w.Error(); err != nil {
+			return err
+		}
+		n++
+		if n%s.runRows == 0 {
+			w.Flush()
+		}
+		if err := rr.next(s); err != nil {
+			return err
+		}
+		if rr.row == nil {
+			heap.Pop(h)
+			continue
+		}
+		heap.Fix(h, 0)
+	}
+	return nil
+}
+
+// close removes the temporary files.
+func (s *extSort) close() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+// run is a sorted run being merged.
+type run struct {
+	index int
+	r     *Reader
+	row   []interface{}
+	key   Key
+}
+
+// next reads the next row of the run. The row is nil at the end of the run.
+func (rr *run) next(s *extSort) error {
+	rr.row, rr.key = nil, nil
+	if !rr.r.Next() {
+		return rr.r.Err()
+	}
+	row, err := rr.r.Values()
+	if err != nil {
+		return err
+	}
+	rr.row, rr.key = row, s.keyOf(row)
+	return nil
+}
+
+// runHeap orders runs by the key of their next row, then by run, so rows
+// with equal keys keep their order.
+type runHeap struct {
+	list []*run
+}
+
+func (h *runHeap) Len() int { return len(h.list) }
+
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.list[i], h.list[j]
+	if c := compareKey(a.key, b.key); c != 0 {
+		return c < 0
+	}
+	return a.index < b.index
+}
+
+func (h *runHeap) Swap(i, j int) { h.list[i], h.list[j] = h.list[j], h.list[i] }
+
+func (h *runHeap) Push(x interface{}) { h.list = append(h.list, x.(*run)) }
+
+func (h *runHeap) Pop() interface{} {
+	x := h.list[len(h.list)-1]
+	h.list = h.list[:len(h.list)-1]
+	return x
+}
+
+// Sorted reports whether the table of the current row is tagged with
+// the tag named SortedTagName.
+func (r *Reader) Sorted() bool {
+	return r.rt != nil && r.sorted(r.rt)
+}
+
+// sorted reports whether rt is tagged with the tag named SortedTagName.
+func (r *Reader) sorted(rt *readTable) bool {
+	for _, tag := range rt.Tags {
+		if r.TagName(tag) == SortedTagName {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag reports whether tags has tag.
+func hasTag(tags Tags, tag Tag) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
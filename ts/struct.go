@@ -0,0 +1,322 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// structField is a struct field mapped to a column.
+type structField struct {
+	Index []int
+	Col   Col
+	Nil   bool // Field can hold a nil value.
+}
+
+var structCache sync.Map // map[reflect.Type][]structField
+
+// structFields returns the mapped fields of struct type t.
+func structFields(t reflect.Type) ([]structField, error) {
+	if v, ok := structCache.Load(t); ok {
+		return v.([]structField), nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("ts: %s is not a struct", t)
+	}
+	var ff []structField
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("ts")
+		if !ok || tag == "-" {
+			continue
+		}
+		if sf.PkgPath != "" {
+			return nil, fmt.Errorf("ts: field %s.%s is not exported", t, sf.Name)
+		}
+		opts := strings.Split(tag, ",")
+		f := structField{
+			Index: sf.Index,
+			Col:   Col{Name: opts[0]},
+		}
+		if len(f.Col.Name) == 0 {
+			return nil, fmt.Errorf("ts: field %s.%s missing column name", t, sf.Name)
+		}
+		if names[f.Col.Name] {
+			return nil, fmt.Errorf("ts: duplicate column %q in %s", f.Col.Name, t)
+		}
+		names[f.Col.Name] = true
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			f.Col.Nullable = true
+			f.Nil = true
+			ft = ft.Elem()
+		}
+		var err error
+		f.Col.Type, err = goType(ft)
+		if err != nil {
+			return nil, fmt.Errorf("ts: field %s.%s: %v", t, sf.Name, err)
+		}
+		switch f.Col.Type {
+		case Bytes, Any:
+			f.Nil = true
+		}
+		for _, o := range opts[1:] {
+			switch {
+			default:
+				return nil, fmt.Errorf("ts: field %s.%s unknown tag option %q", t, sf.Name, o)
+			case o == "key":
+				f.Col.Key = true
+			case o == "default=zero":
+				f.Col.Default = Zero
+				f.Col.Nullable = false
+			case strings.HasPrefix(o, "length="):
+				f.Col.Length, err = strconv.ParseInt(strings.TrimPrefix(o, "length="), 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("ts: field %s.%s invalid length: %v", t, sf.Name, err)
+				}
+			}
+		}
+		ff = append(ff, f)
+	}
+	structCache.Store(t, ff)
+	return ff, nil
+}
+
+// goType returns the column type for Go type t.
+func goType(t reflect.Type) (Type, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Int64, nil
+	case reflect.Bool:
+		return Bool, nil
+	case reflect.String:
+		return String, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Bytes, nil
+		}
+	case reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Len() == hashSizeBytes {
+			return Hash, nil
+		}
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return Any, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported type %s", t)
+}
+
+// checkField reports an error if field f cannot hold the values of column c.
+func checkField(c *Col, f *structField, t reflect.Type) error {
+	name := t.FieldByIndex(f.Index).Name
+	if c.Type != f.Col.Type {
+		return fmt.Errorf("ts: field %s.%s of type %s cannot hold column %q of type %v", t, name, t.FieldByIndex(f.Index).Type, c.Name, c.Type)
+	}
+	if c.Nullable && !f.Nil {
+		return fmt.Errorf("ts: field %s.%s must be a pointer to hold nullable column %q", t, name, c.Name)
+	}
+	return nil
+}
+
+// DefineStruct returns the columns for the mapped fields of struct v.
+// v may be a struct or a pointer to a struct.
+// Pointer fields define Nullable columns.
+//
+// Struct fields are mapped to columns with a "ts" struct tag:
+//
+//	type Person struct {
+//		ID    int64   `ts:"id,key"`
+//		Name  string  `ts:"name,length=100"`
+//		Email *string `ts:"email"`
+//		Admin bool    `ts:"admin,default=zero"`
+//	}
+//
+// The first tag value is the column name. Fields without a tag or
+// with a tag of "-" are not mapped. The remaining options set the column
+// options; InsertStruct and ScanStruct use the same mapping and ignore them.
+//
+// Each column Type maps to a Go type:
+//
+//	Hash   [32]byte
+//	Int64  int, int8, int16, int32, int64
+//	Bool   bool
+//	String string
+//	Bytes  []byte
+//	Any    interface{}
+//
+// A pointer to the Go type holds a Nullable column or a column with a Default.
+// A nil pointer writes no value.
+func DefineStruct(v interface{}) ([]Col, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil, fmt.Errorf("ts: DefineStruct requires a struct")
+	}
+	ff, err := structFields(t)
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]Col, len(ff))
+	for i, f := range ff {
+		cols[i] = f.Col
+	}
+	return cols, nil
+}
+
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return rv, fmt.Errorf("ts: nil struct pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return rv, fmt.Errorf("ts: %T is not a struct", v)
+	}
+	return rv, nil
+}
+
+// InsertStruct inserts the mapped fields of struct v into the table. Fields are
+// mapped to columns as described by DefineStruct.
+// Every mapped field must be a column of the table and have a compatible type.
+// Columns of the table without a field receive no value.
+func (w *Writer) InsertStruct(t TableRef, v interface{}) RowRef {
+	if w.err != nil {
+		return errRow
+	}
+	rv, err := structValue(v)
+	if err != nil {
+		w.err = err
+		return errRow
+	}
+	ti, ok := w.table[t.id]
+	if !ok {
+		w.err = fmt.Errorf("ts: unknown table for %T", v)
+		return errRow
+	}
+	ff, err := structFields(rv.Type())
+	if err != nil {
+		w.err = err
+		return errRow
+	}
+	names := make([]string, len(ff))
+	values := make([]interface{}, len(ff))
+	for i := range ff {
+		f := &ff[i]
+		c, ok := ti.ColumnByName[f.Col.Name]
+		if !ok {
+			w.err = fmt.Errorf("ts: table %q has no column %q for %s", ti.Name, f.Col.Name, rv.Type())
+			return errRow
+		}
+		if err := checkField(c, f, rv.Type()); err != nil {
+			w.err = err
+			return errRow
+		}
+		names[i] = f.Col.Name
+		fv := rv.FieldByIndex(f.Index)
+		switch fv.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice:
+			if fv.IsNil() {
+				continue
+			}
+		}
+		if fv.Kind() == reflect.Ptr {
+			fv = fv.Elem()
+		}
+		values[i] = goValue(fv)
+	}
+	return w.Insert(t.Use(names...), values...)
+}
+
+// goValue returns the value in the form the field coders accept.
+func goValue(fv reflect.Value) interface{} {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fv.Int()
+	case reflect.Bool:
+		return fv.Bool()
+	case reflect.String:
+		return fv.String()
+	case reflect.Slice:
+		return fv.Bytes()
+	case reflect.Array:
+		var h [hashSizeBytes]byte
+		reflect.Copy(reflect.ValueOf(&h).Elem(), fv)
+		return h
+	}
+	return fv.Interface()
+}
+
+// scanStruct assigns the values of cols to the mapped fields of v.
+// Columns without a field are ignored. A field without a column is left
+// unchanged if partial is set and is an error otherwise.
+func scanStruct(cols []Col, values []interface{}, v interface{}, partial bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("ts: ScanStruct requires a non-nil struct pointer, got %T", v)
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("ts: ScanStruct requires a non-nil struct pointer, got %T", v)
+	}
+	ff, err := structFields(rv.Type())
+	if err != nil {
+		return err
+	}
+	for i := range ff {
+		f := &ff[i]
+		ci := -1
+		for j := range cols {
+			if cols[j].Name == f.Col.Name {
+				ci = j
+				break
+			}
+		}
+		if ci < 0 {
+			if partial {
+				continue
+			}
+			return fmt.Errorf("ts: no column %q for %s", f.Col.Name, rv.Type())
+		}
+		if err := checkField(&cols[ci], f, rv.Type()); err != nil {
+			return err
+		}
+		if err := assignReflect(rv.FieldByIndex(f.Index), values[ci]); err != nil {
+			return fmt.Errorf("ts: scan column %q: %v", f.Col.Name, err)
+		}
+	}
+	return nil
+}
+
+// ScanStruct decodes the current row into the mapped fields of the struct
+// pointed to by v.
+func (r *Reader) ScanStruct(v interface{}) error {
+	values, err := r.Values()
+	if err != nil {
+		return err
+	}
+	return scanStruct(r.rt.view(), values, v, false)
+}
+
+// ScanStruct decodes the selected columns of the current row into the
+// mapped fields of the struct pointed to by v. Fields without a selected
+// column are left unchanged.
+func (c *Cursor) ScanStruct(v interface{}) error {
+	values, err := c.Values()
+	if err != nil {
+		return err
+	}
+	return scanStruct(c.Columns(), values, v, true)
+}
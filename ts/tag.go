@@ -0,0 +1,52 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+// DefineTag returns the tag with the given name, writing a new tag to the
+// control tag table if the name is not yet defined. Tags must be defined
+// before they are used by a table or column.
+func (w *Writer) DefineTag(name string) Tag {
+	if w.err != nil {
+		return 0
+	}
+	for tag, n := range w.tags {
+		if n == name {
+			return tag
+		}
+	}
+	ref := w.Insert(w.control[controlTagID].Use("name"), name)
+	if w.err != nil {
+		return 0
+	}
+	tag := Tag(ref.ID())
+	w.tags[tag] = name
+	return tag
+}
+
+// checkTag checks that tag is defined.
+func (w *Writer) checkTag(table, column string, tag Tag) {
+	if w.err != nil {
+		return
+	}
+	if _, ok := w.tags[tag]; !ok {
+		w.err = &IntegrityError{Table: table, Column: column, Value: tag, Reason: "unknown tag"}
+	}
+}
+
+// Tag returns the tag with the given name read from the stream so far.
+func (r *Reader) Tag(name string) (Tag, bool) {
+	for tag, n := range r.tags {
+		if n == name {
+			return tag, true
+		}
+	}
+	return 0, false
+}
+
+// TagName returns the name of tag, or an empty string if the tag
+// has not been read.
+func (r *Reader) TagName(tag Tag) string {
+	return r.tags[tag]
+}
@@ -6,6 +6,13 @@ package ts
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -18,3 +25,1697 @@ func TestEncode(t *testing.T) {
 	}
 	t.Log(buf.Bytes())
 }
+
+func TestReadColumns(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Length: 100},
+		Col{Name: "photo", Type: Bytes, Nullable: true},
+		Col{Name: "active", Type: Bool, Default: Zero},
+		Col{Name: "age", Type: Int64},
+	)
+	w.Insert(person, 1, "Ann", []byte{1, 2, 3}, true, 40)
+	w.Insert(person.Use("id", "name", "age"), 2, "Bob", 31)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	c := r.Cursor("person", "age", "name", "active")
+	type row struct {
+		Age    int64
+		Name   string
+		Active bool
+	}
+	var got []row
+	for c.Next() {
+		var v row
+		if err := c.Scan(&v.Age, &v.Name, &v.Active); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, v)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []row{{40, "Ann", true}, {31, "Bob", false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	if !r.Next() {
+		t.Fatal("expected row", r.Err())
+	}
+	values, err := r.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantValues := []interface{}{int64(1), "Ann", []byte{1, 2, 3}, true, int64(40)}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Fatalf("got %v, want %v", values, wantValues)
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	c = r.Cursor("person", "id", "missing")
+	if c.Next() {
+		t.Fatal("expected invalid column error")
+	}
+	if c.Err() == nil {
+		t.Fatal("expected invalid column error")
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	c = r.Cursor("person", "id", "id")
+	if c.Next() {
+		t.Fatal("expected duplicate column error")
+	}
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), "selected twice") {
+		t.Fatalf("got error %v, want duplicate column error", err)
+	}
+}
+
+func TestStruct(t *testing.T) {
+	type person struct {
+		ID     int64   `ts:"id,key"`
+		Name   string  `ts:"name,length=100"`
+		Email  *string `ts:"email"`
+		Active bool    `ts:"active,default=zero"`
+		Note   string
+	}
+	cols, err := DefineStruct(person{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCols := []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "name", Type: String, Length: 100},
+		{Name: "email", Type: String, Nullable: true},
+		{Name: "active", Type: Bool, Default: Zero},
+	}
+	if !reflect.DeepEqual(cols, wantCols) {
+		t.Fatalf("got %v, want %v", cols, wantCols)
+	}
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	tref := w.Define(Table{Name: "person"}, cols...)
+	email := "ann@example.com"
+	in := []person{
+		{ID: 1, Name: "Ann", Email: &email, Active: true},
+		{ID: 2, Name: "Bob"},
+	}
+	for i := range in {
+		w.InsertStruct(tref, &in[i])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	var got []person
+	for r.Next() {
+		var p person
+		if err := r.ScanStruct(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Fatalf("got %v, want %v", got, in)
+	}
+
+	// A cursor leaves the fields of columns it does not select unchanged.
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	c := r.Cursor("person", "id", "name")
+	got = nil
+	for c.Next() {
+		p := person{Active: true, Note: "kept"}
+		if err := c.ScanStruct(&p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []person{
+		{ID: 1, Name: "Ann", Active: true, Note: "kept"},
+		{ID: 2, Name: "Bob", Active: true, Note: "kept"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	type badPerson struct {
+		ID    string `ts:"id"`
+		Email string `ts:"email"`
+	}
+	w = NewWriter(&bytes.Buffer{})
+	tref = w.Define(Table{Name: "person"}, cols...)
+	w.InsertStruct(tref, badPerson{})
+	if err := w.Error(); err == nil || !strings.HasSuffix(err.Error(), `cannot hold column "id" of type int64`) {
+		t.Fatalf("got error %v, want type mismatch error", err)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+		Col{Name: "email", Type: String, Nullable: true},
+	)
+	w.Insert(person, 1, "Ann", "ann@example.com")
+	w.Update(person.Use("name", "email"), 1, "Anne", nil)
+	w.Delete(person, 1)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	type row struct {
+		Kind    RowKind
+		Values  []interface{}
+		Changed []bool
+	}
+	var got []row
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row{r.Kind(), values, r.Changed()})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []row{
+		{RowData, []interface{}{int64(1), "Ann", "ann@example.com"}, []bool{true, true, true}},
+		{RowUpdate, []interface{}{int64(1), "Anne", nil}, []bool{true, true, true}},
+		{RowDelete, []interface{}{int64(1), nil, nil}, []bool{true, false, false}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	w = NewWriter(&bytes.Buffer{})
+	person = w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+	)
+	w.Update(person.Use("id"), 1, 2)
+	if w.Error() == nil {
+		t.Fatal("expected error updating key column")
+	}
+
+	// Rows for an unknown table or invalid columns are errors, not panics.
+	list := []struct {
+		Name  string
+		Write func(w *Writer, person TableRef)
+		Err   string
+	}{
+		{"insert zero table", func(w *Writer, person TableRef) { w.Insert(TableRef{}) }, "ts: unknown table 0"},
+		{"update zero table", func(w *Writer, person TableRef) { w.Update(TableRef{}, 1) }, "ts: unknown table 0"},
+		{"delete zero table", func(w *Writer, person TableRef) { w.Delete(TableRef{}, 1) }, "ts: unknown table 0"},
+		{"delete failed table", func(w *Writer, person TableRef) { w.Delete(errTable, 1) }, "ts: unknown table -1"},
+		{"delete invalid names", func(w *Writer, person TableRef) { w.Delete(person.Use("missing"), 1) }, `ts: invalid table names: ["missing"]`},
+	}
+	for _, item := range list {
+		t.Run(item.Name, func(t *testing.T) {
+			w := NewWriter(&bytes.Buffer{})
+			person := w.Define(Table{Name: "person"},
+				Col{Name: "id", Type: Int64, Key: true},
+			)
+			item.Write(w, person)
+			if err := w.Error(); err == nil || err.Error() != item.Err {
+				t.Fatalf("got error %v, want %q", err, item.Err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	// Tags defined before pii give pii a different ID in each stream.
+	define := func(w *Writer, tags ...string) (TableRef, TableRef) {
+		for _, name := range tags {
+			w.DefineTag(name)
+		}
+		pii := w.DefineTag("pii")
+		team := w.Define(Table{Name: "team"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "name", Type: String},
+		)
+		person := w.Define(Table{Name: "person"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "name", Type: String, Tags: Tags{pii}},
+			Col{Name: "team", Type: Int64, Link: team.ID(), Nullable: true},
+		)
+		return team, person
+	}
+
+	base := &bytes.Buffer{}
+	w := NewWriter(base)
+	team, person := define(w)
+	w.Insert(team, 1, "red")
+	w.Insert(person, 1, "Ann", 1)
+	w.Insert(person, 2, "Bob", 1)
+	w.Insert(person, 3, "Cal", nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	delta := &bytes.Buffer{}
+	w = NewWriter(delta)
+	w.CheckIntegrity(true)
+	team, person = define(w, "readonly")
+	w.Insert(team, 2, "blue")
+	w.Update(person.Use("team"), 3, 2)
+	w.Delete(person, 2)
+	w.Insert(person, 4, "Dee", nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := Apply(bytes.NewReader(base.Bytes()), bytes.NewReader(delta.Bytes()), out); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(out)
+	var got [][]interface{}
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, append([]interface{}{r.Table().Name}, values...))
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{"team", int64(1), "red"},
+		{"team", int64(2), "blue"},
+		{"person", int64(1), "Ann", int64(1)},
+		{"person", int64(3), "Cal", int64(2)},
+		{"person", int64(4), "Dee", nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, def := range r.Tables() {
+		if def.Name != "person" {
+			continue
+		}
+		if tags := def.Columns[1].Tags; len(tags) != 1 || r.TagName(tags[0]) != "pii" {
+			t.Fatalf("got person.name tags %v, want pii", tags)
+		}
+	}
+
+	delta.Reset()
+	w = NewWriter(delta)
+	_, person = define(w)
+	w.Insert(person, 1, "Ann", nil)
+	w.Delete(person, 9)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err := Apply(bytes.NewReader(base.Bytes()), delta, out)
+	ae, ok := err.(*ApplyError)
+	if !ok {
+		t.Fatalf("got error %v, want *ApplyError", err)
+	}
+	wantConflicts := []Conflict{
+		{Table: "person", Key: Key{int64(1)}, Kind: RowData, Reason: "duplicate key"},
+		{Table: "person", Key: Key{int64(9)}, Kind: RowDelete, Reason: "key not found"},
+	}
+	if !reflect.DeepEqual(ae.Conflicts, wantConflicts) {
+		t.Fatalf("got conflicts %v, want %v", ae.Conflicts, wantConflicts)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("wrote %d bytes on conflict", out.Len())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	emailTag := "pii"
+	snapshot := func(extra bool, rows ...[]interface{}) []byte {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		w.CheckIntegrity(true)
+		tag := w.DefineTag(emailTag)
+		person := w.Define(Table{Name: "person"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "name", Type: String},
+			Col{Name: "email", Type: String, Nullable: true, Tags: Tags{tag}},
+		)
+		for _, row := range rows {
+			w.Insert(person, row...)
+		}
+		if extra {
+			w.Define(Table{Name: "team"}, Col{Name: "id", Type: Int64, Key: true})
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	old := snapshot(false,
+		[]interface{}{1, "Ann", "ann@example.com"},
+		[]interface{}{2, "Bob", nil},
+		[]interface{}{3, "Cal", nil},
+	)
+	new := snapshot(false,
+		[]interface{}{1, "Ann", nil},
+		[]interface{}{3, "Cal", nil},
+		[]interface{}{4, "Dee", "dee@example.com"},
+	)
+
+	delta := &bytes.Buffer{}
+	if err := Diff(bytes.NewReader(old), bytes.NewReader(new), delta); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(bytes.NewReader(delta.Bytes()))
+	type row struct {
+		Kind    RowKind
+		Values  []interface{}
+		Changed []bool
+	}
+	var got []row
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row{r.Kind(), values, r.Changed()})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []row{
+		{RowDelete, []interface{}{int64(2), nil, nil}, []bool{true, false, false}},
+		{RowUpdate, []interface{}{int64(1), nil, nil}, []bool{true, false, true}},
+		{RowData, []interface{}{int64(4), "Dee", "dee@example.com"}, []bool{true, true, true}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	applied := &bytes.Buffer{}
+	if err := Apply(bytes.NewReader(old), delta, applied); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(applied.Bytes(), new) {
+		t.Fatal("applying the diff did not give the new snapshot")
+	}
+
+	err := Diff(bytes.NewReader(old), bytes.NewReader(snapshot(true)), &bytes.Buffer{})
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("got error %v, want *SchemaError", err)
+	}
+	wantDiffs := []SchemaDiff{{Table: "team", Reason: "table added"}}
+	if !reflect.DeepEqual(se.Diffs, wantDiffs) {
+		t.Fatalf("got diffs %v, want %v", se.Diffs, wantDiffs)
+	}
+
+	emailTag = "secret"
+	err = Diff(bytes.NewReader(old), bytes.NewReader(snapshot(false)), &bytes.Buffer{})
+	se, ok = err.(*SchemaError)
+	if !ok {
+		t.Fatalf("got error %v, want *SchemaError", err)
+	}
+	wantDiffs = []SchemaDiff{{Table: "person", Column: "email", Reason: "column definition changed"}}
+	if !reflect.DeepEqual(se.Diffs, wantDiffs) {
+		t.Fatalf("got diffs %v, want %v", se.Diffs, wantDiffs)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	define := func(w *Writer) (TableRef, TableRef) {
+		person := w.Define(Table{Name: "person"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "name", Type: String},
+		)
+		team := w.Define(Table{Name: "team"},
+			Col{Name: "id", Type: Int64, Key: true},
+		)
+		return person, team
+	}
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	person, team := define(w)
+	w.Insert(person, 1, "Ann")
+	w.Validate(person, 1, "name", 10, "name is reserved")
+	w.Insert(person, 2, "")
+	w.Validate(person, 2, "", 20, "row rejected")
+	w.Validate(team, 0, "", 30, "table is read only")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	var ids []int64
+	for r.Next() {
+		ids = append(ids, r.RowID())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got row IDs %v, want %v", ids, want)
+	}
+	want := []Validation{
+		{Table: "person", Row: 1, Column: "name", Code: 10, Message: "name is reserved"},
+		{Table: "person", Row: 2, Code: 20, Message: "row rejected"},
+		{Table: "team", Code: 30, Message: "table is read only"},
+	}
+	if got := r.Validations(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	w = NewWriter(&bytes.Buffer{})
+	person, _ = define(w)
+	w.Validate(person, 1, "missing", 1, "")
+	if w.Error() == nil {
+		t.Fatal("expected error for unknown column")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	order := w.Define(Table{Name: "order"},
+		Col{Name: "id", Type: Int64, Key: true},
+	)
+	line := w.Define(Table{Name: "line"},
+		Col{Name: "order", Type: Int64, Link: order.ID()},
+		Col{Name: "item", Type: String},
+	)
+	w.Insert(order, 1)
+	w.BeginGroup()
+	w.Insert(order, 2)
+	w.Insert(line, 2, "pen")
+	w.Insert(line, 2, "ink")
+	w.CommitGroup()
+	w.BeginGroup()
+	w.Insert(order, 3)
+	w.Insert(line, 3, "cup")
+	w.Flush()
+	if err := w.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	type row struct {
+		Group int64
+		Table string
+		Value interface{}
+	}
+	var got []row
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row{r.Group(), r.Table().Name, values[len(values)-1]})
+	}
+	if err := r.Err(); err != ErrStreamCancel {
+		t.Fatalf("got error %v, want %v", err, ErrStreamCancel)
+	}
+	want := []row{
+		{0, "order", int64(1)},
+		{1, "order", int64(2)},
+		{1, "line", "pen"},
+		{1, "line", "ink"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	w = NewWriter(&bytes.Buffer{})
+	w.BeginGroup()
+	if err := w.Close(); err == nil {
+		t.Fatal("expected error closing an open group")
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	define := func() (*Writer, TableRef, TableRef) {
+		w := NewWriter(&bytes.Buffer{})
+		w.CheckIntegrity(true)
+		team := w.Define(Table{Name: "team"},
+			Col{Name: "id", Type: Int64, Key: true},
+		)
+		person := w.Define(Table{Name: "person"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "team", Type: Int64, Link: team.ID(), Nullable: true},
+		)
+		return w, team, person
+	}
+
+	w, team, person := define()
+	w.Insert(team, 1)
+	w.Insert(person, 1, 1)
+	w.Insert(person, 2, nil)
+	w.Delete(person, 2)
+	w.Insert(person, 2, 1)
+	w.Update(person.Use("team"), 2, nil)
+	e := w.EncodeRow(team)
+	e.Int64(2)
+	e.Done()
+	w.Insert(person, 3, 2)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	list := []struct {
+		Name  string
+		Write func(w *Writer, team, person TableRef)
+		Want  IntegrityError
+	}{
+		{
+			Name: "duplicate key",
+			Write: func(w *Writer, team, person TableRef) {
+				w.Insert(team, 1)
+				w.Insert(team, int64(1))
+			},
+			Want: IntegrityError{Table: "team", Column: "id", Value: int64(1), Reason: "duplicate key"},
+		},
+		{
+			Name: "encoded duplicate key",
+			Write: func(w *Writer, team, person TableRef) {
+				w.Insert(team, 1)
+				e := w.EncodeRow(team)
+				e.Int64(1)
+				e.Done()
+			},
+			Want: IntegrityError{Table: "team", Column: "id", Value: int64(1), Reason: "duplicate key"},
+		},
+		{
+			Name: "encoded missing link",
+			Write: func(w *Writer, team, person TableRef) {
+				e := w.EncodeRow(person)
+				e.Int64(1)
+				e.Int64(4)
+				e.Done()
+			},
+			Want: IntegrityError{Table: "person", Column: "team", Value: int64(4), Reason: `no row in linked table "team"`},
+		},
+		{
+			Name: "missing link",
+			Write: func(w *Writer, team, person TableRef) {
+				w.Insert(team, 1)
+				w.Insert(person, 1, 2)
+			},
+			Want: IntegrityError{Table: "person", Column: "team", Value: 2, Reason: `no row in linked table "team"`},
+		},
+		{
+			Name: "update missing link",
+			Write: func(w *Writer, team, person TableRef) {
+				w.Insert(person, 1, nil)
+				w.Update(person.Use("team"), 1, 3)
+			},
+			Want: IntegrityError{Table: "person", Column: "team", Value: 3, Reason: `no row in linked table "team"`},
+		},
+		{
+			Name: "unknown tag",
+			Write: func(w *Writer, team, person TableRef) {
+				w.Define(Table{Name: "note"}, Col{Name: "text", Type: String, Tags: Tags{TagHidden, 99}})
+			},
+			Want: IntegrityError{Table: "note", Column: "text", Value: Tag(99), Reason: "unknown tag"},
+		},
+	}
+	for _, item := range list {
+		t.Run(item.Name, func(t *testing.T) {
+			w, team, person := define()
+			item.Write(w, team, person)
+			err, ok := w.Error().(*IntegrityError)
+			if !ok {
+				t.Fatalf("got error %v, want *IntegrityError", w.Error())
+			}
+			if !reflect.DeepEqual(*err, item.Want) {
+				t.Fatalf("got %#v, want %#v", *err, item.Want)
+			}
+		})
+	}
+}
+
+func TestRowRef(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	team := w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+	)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64, Link: team.ID()},
+	)
+	note := w.Define(Table{Name: "note"},
+		Col{Name: "text", Type: String},
+	)
+	red := w.Insert(team.Use("name"), "red")
+	blue := w.Insert(team, 10, "blue")
+	green := w.Insert(team, nil, "green")
+	ann := w.Insert(person.Use("team"), blue)
+	w.Update(person.Use("team"), ann, green)
+	n1 := w.Insert(note, "a")
+	n2 := w.Insert(note, "b")
+	if err := w.Error(); err != nil {
+		t.Fatal(err)
+	}
+	got := []int64{red.ID(), blue.ID(), green.ID(), ann.ID(), n1.ID(), n2.ID()}
+	if want := []int64{1, 10, 11, 1, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got IDs %v, want %v", got, want)
+	}
+	if ann.Table() != person.ID() {
+		t.Fatalf("got table %d, want %d", ann.Table(), person.ID())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	var rows [][]interface{}
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, values)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{int64(1), "red"},
+		{int64(10), "blue"},
+		{int64(11), "green"},
+		{int64(1), int64(10)},
+		{int64(1), int64(11)},
+		{"a"},
+		{"b"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, want %v", rows, want)
+	}
+
+	w = NewWriter(&bytes.Buffer{})
+	team = w.Define(Table{Name: "team"}, Col{Name: "id", Type: Int64, Key: true})
+	person = w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64, Link: team.ID()},
+	)
+	p := w.Insert(person, 1, w.Insert(team, 1))
+	w.Insert(person, 2, p)
+	if w.Error() == nil {
+		t.Fatal("expected error linking to a row of the wrong table")
+	}
+}
+
+func TestTags(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	pii := w.DefineTag("pii")
+	readonly := w.DefineTag("readonly")
+	if again := w.DefineTag("pii"); again != pii {
+		t.Fatalf("got tag %d for pii again, want %d", again, pii)
+	}
+	if pii == TagHidden || pii == readonly {
+		t.Fatalf("tags not unique: pii=%d readonly=%d", pii, readonly)
+	}
+	person := w.Define(Table{Name: "person", Tags: Tags{readonly}},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "email", Type: String, Tags: Tags{pii, TagHidden}},
+	)
+	w.Insert(person, 1, "ann@example.com")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	for r.Next() {
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	def := r.Tables()[0]
+	var names []string
+	for _, tag := range append(def.Tags, def.Columns[1].Tags...) {
+		names = append(names, r.TagName(tag))
+	}
+	if want := []string{"readonly", "pii", "hidden"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got tag names %q, want %q", names, want)
+	}
+	if tag, ok := r.Tag("pii"); !ok || tag != pii {
+		t.Fatalf("got tag %d, %t for pii, want %d", tag, ok, pii)
+	}
+
+	w = NewWriter(&bytes.Buffer{})
+	w.Define(Table{Name: "person"}, Col{Name: "id", Type: Int64, Tags: Tags{42}})
+	if _, ok := w.Error().(*IntegrityError); !ok {
+		t.Fatalf("got error %v, want *IntegrityError for unknown tag", w.Error())
+	}
+	w = NewWriter(&bytes.Buffer{})
+	person = w.Define(Table{Name: "person"}, Col{Name: "id", Type: Int64, Tags: Tags{TagHidden}})
+	w.Redefine(person, Col{Name: "id", Type: Int64, Tags: Tags{42}})
+	if _, ok := w.Error().(*IntegrityError); !ok {
+		t.Fatalf("got error %v, want *IntegrityError for unknown tag on redefine", w.Error())
+	}
+}
+
+func TestExpect(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Length: 50},
+		Col{Name: "active", Type: Bool},
+		Col{Name: "old", Type: String},
+	)
+	w.Insert(person, 1, "Ann", true, "x")
+	w.Update(person.Use("active"), 1, false)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+
+	r := NewReader(bytes.NewReader(stream))
+	r.Expect("person",
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "active", Type: Int64},
+		Col{Name: "name", Type: Bytes},
+		Col{Name: "team", Type: Int64, Default: int64(7)},
+		Col{Name: "email", Type: String, Nullable: true},
+	)
+	type row struct {
+		Values  []interface{}
+		Changed []bool
+	}
+	var got []row
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row{values, r.Changed()})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []row{
+		{[]interface{}{int64(1), int64(1), []byte("Ann"), int64(7), nil}, []bool{true, true, true, true, true}},
+		{[]interface{}{int64(1), int64(0), nil, nil, nil}, []bool{true, true, false, false, false}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	r = NewReader(bytes.NewReader(stream))
+	r.Expect("person", Col{Name: "id", Type: Int64, Key: true}, Col{Name: "name", Type: String})
+	c := r.Cursor("person", "name")
+	var names []string
+	for c.Next() {
+		var name string
+		if c.Kind() != RowData {
+			continue
+		}
+		if err := c.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"Ann"}) {
+		t.Fatalf("got names %q", names)
+	}
+
+	list := []struct {
+		Col Col
+		Err string
+	}{
+		{Col{Name: "name", Type: String, Length: 10}, "ts: column person.name: length 50 cannot be read as length 10"},
+		{Col{Name: "active", Type: String}, "ts: column person.active: bool cannot be read as string"},
+		{Col{Name: "team", Type: Int64}, "ts: column person.team is not in the stream and has no default"},
+	}
+	for _, item := range list {
+		r = NewReader(bytes.NewReader(stream))
+		r.Expect("person", item.Col)
+		for r.Next() {
+		}
+		if err := r.Err(); err == nil || err.Error() != item.Err {
+			t.Errorf("for %s got error %v, want %q", item.Col.Name, err, item.Err)
+		}
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	old := []TableDef{
+		{ID: 8, Table: Table{Name: "team"}, Columns: []Col{
+			{Name: "id", Type: Int64, Key: true},
+		}},
+		{ID: 9, Table: Table{Name: "person"}, Columns: []Col{
+			{Name: "id", Type: Int64, Key: true},
+			{Name: "name", Type: String, Length: 50},
+			{Name: "active", Type: Bool},
+			{Name: "team", Type: Int64, Link: 8},
+			{Name: "note", Type: String, Nullable: true},
+			{Name: "code", Type: String},
+		}},
+		{ID: 10, Table: Table{Name: "log"}},
+	}
+	next := []TableDef{
+		{ID: 8, Table: Table{Name: "person"}, Columns: []Col{
+			{Name: "id", Type: Int64, Key: true},
+			{Name: "name", Type: String, Length: 100},
+			{Name: "active", Type: Int64},
+			{Name: "team", Type: Int64, Link: 9},
+			{Name: "email", Type: String, Nullable: true},
+		}},
+		{ID: 9, Table: Table{Name: "team"}, Columns: []Col{
+			{Name: "id", Type: Int64, Key: true},
+		}},
+	}
+	r := CheckCompatibility(old, next)
+	want := []SchemaChange{
+		{Table: "log", Compatibility: Backward, Description: "table removed"},
+		{Table: "person", Column: "name", Compatibility: Backward, Description: "length changed from 50 to 100"},
+		{Table: "person", Column: "active", Compatibility: Backward, Description: "type changed from bool to int64"},
+		{Table: "person", Column: "email", Compatibility: Compatible, Description: "column added"},
+		{Table: "person", Column: "note", Compatibility: Compatible, Description: "column removed"},
+		{Table: "person", Column: "code", Compatibility: Backward, Description: "column removed"},
+	}
+	if !reflect.DeepEqual(r.Changes, want) {
+		t.Fatalf("got %v, want %v", r.Changes, want)
+	}
+	if c := r.Compatibility(); c != Backward {
+		t.Fatalf("got %v, want %v", c, Backward)
+	}
+
+	next[0].Columns[0].Key = false
+	next[0].Columns = append(next[0].Columns, Col{Name: "code", Type: Bytes, Length: 8})
+	r = CheckCompatibility(old, next)
+	if c := r.Compatibility(); c != Breaking {
+		t.Fatalf("got %v, want %v:\n%v", c, Breaking, r)
+	}
+	if s := r.String(); !strings.Contains(s, "\tperson.id: key changed from true to false (breaking)\n") {
+		t.Fatalf("unexpected report:\n%s", s)
+	}
+
+	// Definitions not read from a stream have zero IDs.
+	a := TableDef{Table: Table{Name: "a"}, Columns: []Col{{Name: "id", Type: Int64, Key: true}}}
+	b := TableDef{Table: Table{Name: "b"}, Columns: []Col{{Name: "id", Type: Int64, Key: true}}}
+	r = CheckCompatibility([]TableDef{a}, []TableDef{a, b})
+	want = []SchemaChange{{Table: "b", Compatibility: Forward, Description: "table added"}}
+	if !reflect.DeepEqual(r.Changes, want) {
+		t.Fatalf("got %v, want %v", r.Changes, want)
+	}
+}
+
+func TestRedefine(t *testing.T) {
+	v1 := []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "name", Type: String},
+	}
+	v2 := []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "email", Type: String, Nullable: true},
+		{Name: "name", Type: String},
+	}
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	person := w.Define(Table{Name: "person"}, v1...)
+	w.Insert(person, 1, "Ann")
+	person2 := w.Redefine(person, v2...)
+	if person2.ID() != person.ID() {
+		t.Fatalf("got table ID %d, want %d", person2.ID(), person.ID())
+	}
+	w.Insert(person2, 2, "bob@example.com", "Bob")
+	person = w.Redefine(person2, v1...)
+	w.Insert(person, 3, "Cal")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(buf)
+	var got [][]interface{}
+	var versions [][32]byte
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, values)
+		versions = append(versions, r.Version())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{int64(1), "Ann"},
+		{int64(2), "bob@example.com", "Bob"},
+		{int64(3), "Cal"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if versions[0] != versions[2] || versions[0] == versions[1] {
+		t.Fatalf("unexpected versions %x", versions)
+	}
+	if cols := r.Tables()[0].Columns; len(cols) != len(v1) {
+		t.Fatalf("got %d columns, want %d", len(cols), len(v1))
+	}
+
+	// A cursor selects the columns of each version.
+	buf.Reset()
+	w = NewWriter(buf)
+	person = w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+		Col{Name: "age", Type: Int64},
+	)
+	w.Insert(person, 1, "Ann", 30)
+	person = w.Redefine(person,
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "age", Type: Int64},
+	)
+	w.Insert(person, 2, 40)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c := NewReader(buf).Cursor("person", "age")
+	var ages []interface{}
+	for c.Next() {
+		values, err := c.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ages = append(ages, values...)
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int64(30), int64(40)}; !reflect.DeepEqual(ages, want) {
+		t.Fatalf("got ages %v, want %v", ages, want)
+	}
+
+	// Keys written before a redefinition with the same key columns are kept.
+	w = NewWriter(&bytes.Buffer{})
+	w.CheckIntegrity(true)
+	team := w.Define(Table{Name: "team"}, Col{Name: "id", Type: Int64, Key: true})
+	person = w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64, Link: team.ID()},
+	)
+	w.Insert(team, 1)
+	team = w.Redefine(team,
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Nullable: true},
+	)
+	w.Insert(person, 1, 1)
+	if err := w.Error(); err != nil {
+		t.Fatalf("link to a row written before the redefinition: %v", err)
+	}
+	w.Insert(team, 1, "red")
+	if err, ok := w.Error().(*IntegrityError); !ok || err.Reason != "duplicate key" {
+		t.Fatalf("got error %v, want duplicate key", w.Error())
+	}
+}
+
+func TestParallel(t *testing.T) {
+	write := func(parallel int) []byte {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		w.Parallel(parallel)
+		team := w.Define(Table{Name: "team"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "name", Type: String},
+		)
+		person := w.Define(Table{Name: "person"},
+			Col{Name: "id", Type: Int64, Key: true},
+			Col{Name: "team", Type: Int64, Link: team.ID()},
+			Col{Name: "note", Type: Bytes, Nullable: true},
+		)
+		for i := 1; i <= 10; i++ {
+			w.Insert(team, i, "team")
+		}
+		note := make([]byte, 16)
+		for i := 1; i <= 3*parallelRows; i++ {
+			var v []byte
+			if i%3 == 0 {
+				// The buffer is reused for each row.
+				v = note[:i%17]
+				for j := range v {
+					v[j] = byte(i)
+				}
+			}
+			w.Insert(person, i, i%10+1, v)
+			if i == parallelRows {
+				w.Flush()
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	want := write(1)
+	for _, n := range []int{2, 4, 7} {
+		if got := write(n); !bytes.Equal(got, want) {
+			t.Fatalf("parallel %d output differs from sequential output", n)
+		}
+	}
+
+	// An invalid value is reported by the Flush that encodes it.
+	w := NewWriter(&bytes.Buffer{})
+	w.Parallel(4)
+	team := w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Length: 4},
+	)
+	w.Insert(team, 1, "red")
+	w.Insert(team, 2, "orange")
+	w.Insert(team, 3, "green")
+	if err := w.Error(); err != nil {
+		t.Fatalf("error before flush: %v", err)
+	}
+	w.Flush()
+	if err := w.Error(); err == nil || !strings.Contains(err.Error(), "contains 6 runes") {
+		t.Fatalf("got error %v, want error for the first long name", err)
+	}
+}
+
+func BenchmarkParallel(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				w := NewWriter(ioutil.Discard)
+				w.Parallel(n)
+				person := w.Define(Table{Name: "person"},
+					Col{Name: "id", Type: Int64, Key: true},
+					Col{Name: "name", Type: String},
+					Col{Name: "note", Type: Bytes, Nullable: true},
+				)
+				for id := 1; id <= 4*parallelRows; id++ {
+					w.Insert(person, id, "name", []byte("note"))
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadParallel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	team := w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+	)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64},
+		Col{Name: "note", Type: String, Nullable: true},
+	)
+	for i := 1; i <= 200; i++ {
+		w.Insert(team, i, "team")
+		w.Insert(person, i, i%7, nil)
+		if i%10 == 0 {
+			w.Update(person.Use("note"), i-5, "changed")
+			w.Flush()
+		}
+	}
+	w.Delete(team, 3)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+
+	want := make(map[string][][]interface{})
+	r := NewReader(bytes.NewReader(stream))
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := r.Table().Name
+		want[name] = append(want[name], append([]interface{}{r.Kind(), r.RowID()}, values...))
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{1, 3, 8} {
+		var mu sync.Mutex
+		got := make(map[string][][]interface{})
+		err := ReadParallel(bytes.NewReader(stream), n, func(b *Batch) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for i, row := range b.Rows {
+				got[b.Table.Name] = append(got[b.Table.Name], append([]interface{}{b.Kinds[i], b.IDs[i]}, row...))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("workers %d: rows differ from sequential read", n)
+		}
+	}
+
+	stop := errors.New("stop")
+	err := ReadParallel(bytes.NewReader(stream), 4, func(b *Batch) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("got error %v, want %v", err, stop)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	shard1 := &bytes.Buffer{}
+	w := NewWriter(shard1)
+	team := w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+	)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64, Link: team.ID()},
+		Col{Name: "note", Type: String, Nullable: true},
+	)
+	w.Insert(team, 1, "red")
+	w.Insert(person, 2, 1, "second")
+	w.Insert(person, 1, 1, nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	shard2 := &bytes.Buffer{}
+	w = NewWriter(shard2)
+	pii := w.DefineTag("pii")
+	other := w.Define(Table{Name: "other"}, Col{Name: "x", Type: Bool})
+	team = w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+	)
+	person = w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64, Link: team.ID()},
+	)
+	w.Define(Table{Name: "secret", Tags: Tags{pii}}, Col{Name: "v", Type: String})
+	w.Insert(other, true)
+	w.Insert(team, 2, "blue")
+	w.Insert(person, 3, 2)
+	w.Insert(person, 2, 2)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(b []byte) ([][]interface{}, *Reader) {
+		r := NewReader(bytes.NewReader(b))
+		var got [][]interface{}
+		for r.Next() {
+			values, err := r.Values()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, append([]interface{}{r.Table().Name}, values...))
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got, r
+	}
+
+	out := &bytes.Buffer{}
+	if err := Merge(out, bytes.NewReader(shard1.Bytes()), bytes.NewReader(shard2.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	got, r := read(out.Bytes())
+	want := [][]interface{}{
+		{"team", int64(1), "red"},
+		{"person", int64(2), int64(1), "second"},
+		{"person", int64(1), int64(1), nil},
+		{"other", true},
+		{"team", int64(2), "blue"},
+		{"person", int64(3), int64(2), nil},
+		{"person", int64(2), int64(2), nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	defs := r.Tables()
+	if len(defs) != 4 || defs[3].Name != "secret" || r.TagName(defs[3].Tags[0]) != "pii" {
+		t.Fatalf("unexpected tables %v", defs)
+	}
+	if defs[1].Columns[1].Link != defs[0].ID {
+		t.Fatalf("person.team links to %d, want %d", defs[1].Columns[1].Link, defs[0].ID)
+	}
+
+	out.Reset()
+	err := MergeOptions{SortByKey: true}.Merge(out, bytes.NewReader(shard1.Bytes()), bytes.NewReader(shard2.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = read(out.Bytes())
+	want = [][]interface{}{
+		{"team", int64(1), "red"},
+		{"team", int64(2), "blue"},
+		{"person", int64(1), int64(1), nil},
+		{"person", int64(2), int64(2), nil},
+		{"person", int64(3), int64(2), nil},
+		{"other", true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("sorted got %v, want %v", got, want)
+	}
+
+	bad := &bytes.Buffer{}
+	w = NewWriter(bad)
+	w.Define(Table{Name: "team"}, Col{Name: "id", Type: String, Key: true})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Merge(&bytes.Buffer{}, bytes.NewReader(shard1.Bytes()), bad); err == nil {
+		t.Fatal("expected error merging incompatible table")
+	}
+
+	// An input that redefines a table redefines the merged table.
+	redefined := &bytes.Buffer{}
+	w = NewWriter(redefined)
+	person = w.Define(Table{Name: "person"}, Col{Name: "id", Type: Int64, Key: true})
+	w.Insert(person, 2)
+	person = w.Redefine(person,
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Nullable: true},
+	)
+	w.Insert(person, 1, "Ann")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	list := []struct {
+		opt  MergeOptions
+		want [][]interface{}
+	}{
+		{MergeOptions{}, [][]interface{}{{"person", int64(2)}, {"person", int64(1), "Ann"}}},
+		{MergeOptions{SortByKey: true}, [][]interface{}{{"person", int64(1), "Ann"}, {"person", int64(2), nil}}},
+	}
+	for _, item := range list {
+		out.Reset()
+		if err := item.opt.Merge(out, bytes.NewReader(redefined.Bytes())); err != nil {
+			t.Fatalf("%+v: %v", item.opt, err)
+		}
+		if got, _ = read(out.Bytes()); !reflect.DeepEqual(got, item.want) {
+			t.Fatalf("%+v got %v, want %v", item.opt, got, item.want)
+		}
+	}
+}
+
+func TestSortTable(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	team := w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+	)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "team", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Key: true},
+		Col{Name: "n", Type: Int64},
+	)
+	w.Insert(team, 1)
+	const count = 500
+	for i := 0; i < count; i++ {
+		w.Insert(person, (i*7)%5, fmt.Sprintf("p%03d", (i*13)%100), i)
+		if i%50 == 0 {
+			w.Flush()
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, runRows := range []int{0, 64} {
+		out := &bytes.Buffer{}
+		dir, err := ioutil.TempDir("", "ts-sort-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		opt := SortOptions{RunRows: runRows, Dir: dir}
+		if err := opt.SortTable(out, bytes.NewReader(buf.Bytes()), "person"); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("%d temporary files left", len(files))
+		}
+		r := NewReader(out)
+		var prev Key
+		var prevN int64
+		n := 0
+		for r.Next() {
+			if r.Table().Name != "person" {
+				continue
+			}
+			if !r.Sorted() {
+				t.Fatal("table not tagged sorted")
+			}
+			var team, num int64
+			var name string
+			if err := r.Scan(&team, &name, &num); err != nil {
+				t.Fatal(err)
+			}
+			key := Key{team, name}
+			if prev != nil {
+				c := compareKey(prev, key)
+				if c > 0 || c == 0 && prevN > num {
+					t.Fatalf("row %v %d after %v %d", key, num, prev, prevN)
+				}
+			}
+			prev, prevN = key, num
+			n++
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n != count {
+			t.Fatalf("got %d rows, want %d", n, count)
+		}
+	}
+
+	if err := SortTable(&bytes.Buffer{}, bytes.NewReader(buf.Bytes()), "missing"); err == nil {
+		t.Fatal("expected error sorting missing table")
+	}
+
+	// Rows written before a redefinition are sorted with the new columns,
+	// including rows already written to runs.
+	buf.Reset()
+	w = NewWriter(buf)
+	person = w.Define(Table{Name: "person"}, Col{Name: "id", Type: Int64, Key: true})
+	for _, id := range []int{5, 3, 9} {
+		w.Insert(person, id)
+	}
+	person = w.Redefine(person,
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Nullable: true},
+	)
+	w.Insert(person, 1, "a")
+	w.Insert(person, 7, "b")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := (SortOptions{RunRows: 2}).SortTable(out, bytes.NewReader(buf.Bytes()), "person"); err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(out)
+	var got [][]interface{}
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, values)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{int64(1), "a"},
+		{int64(3), nil},
+		{int64(5), nil},
+		{int64(7), "b"},
+		{int64(9), nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	team := w.Define(Table{Name: "team"},
+		Col{Name: "id", Type: Int64, Key: true},
+	)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String},
+	)
+	w.Insert(team, 1)
+	const count = 100
+	for i := 0; i < count; i++ {
+		id := (i * 37) % count * 2
+		w.Insert(person, id, fmt.Sprintf("p%d", id))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	opt := SortOptions{RunRows: 16, KeyIndex: true}
+	if err := opt.SortTable(out, bytes.NewReader(buf.Bytes()), "person"); err != nil {
+		t.Fatal(err)
+	}
+	sorted := out.Bytes()
+
+	r := NewReader(bytes.NewReader(sorted))
+	for _, id := range []int64{0, 2, 30, 32, 198} {
+		values, err := r.Lookup("person", id)
+		if err != nil {
+			t.Fatalf("lookup %d: %v", id, err)
+		}
+		want := []interface{}{id, fmt.Sprintf("p%d", id)}
+		if !reflect.DeepEqual(values, want) {
+			t.Fatalf("lookup %d got %v, want %v", id, values, want)
+		}
+	}
+	for _, id := range []int64{-1, 31, 200} {
+		if _, err := r.Lookup("person", id); err != ErrKeyNotFound {
+			t.Fatalf("lookup %d got error %v, want %v", id, err, ErrKeyNotFound)
+		}
+	}
+	if _, err := r.Lookup("missing", 1); err == nil {
+		t.Fatal("expected error looking up missing table")
+	}
+	n := 0
+	for r.Next() {
+		n++
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != count+1 {
+		t.Fatalf("got %d rows, want %d", n, count+1)
+	}
+
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	if _, err := r.Lookup("person", 2); err != ErrNotIndexed {
+		t.Fatalf("got error %v for stream without key index, want %v", err, ErrNotIndexed)
+	}
+
+	// Tables that are not sorted or are redefined are not indexed.
+	buf.Reset()
+	w = NewWriter(buf)
+	w.KeyIndex(true)
+	person = w.Define(Table{Name: "person"}, Col{Name: "id", Type: Int64, Key: true})
+	sortedTag := w.DefineTag(SortedTagName)
+	team = w.Define(Table{Name: "team", Tags: Tags{sortedTag}}, Col{Name: "id", Type: Int64, Key: true})
+	for _, id := range []int{50, 10, 90, 20} {
+		w.Insert(person, id)
+		w.Insert(team, id/10)
+		w.Flush()
+	}
+	team = w.Redefine(team,
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Nullable: true},
+	)
+	w.Insert(team, 10, "ten")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r = NewReader(bytes.NewReader(buf.Bytes()))
+	for _, table := range []string{"person", "team"} {
+		if _, err := r.Lookup(table, 10); err != ErrNotIndexed {
+			t.Fatalf("lookup in %s got error %v, want %v", table, err, ErrNotIndexed)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	cols := []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "name", Type: String},
+		{Name: "active", Type: Bool, Default: Zero},
+		{Name: "photo", Type: Bytes, Nullable: true},
+		{Name: "secret", Type: String, Nullable: true, Tags: Tags{TagHidden}},
+	}
+	const src = "id,name,active,photo,secret\n" +
+		"1,Ann,true,AQI=,s1\n" +
+		"2,\"Bob, Jr\",,,\n"
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	if _, err := FromCSV(w, strings.NewReader(src), Table{Name: "person"}, cols...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := ToCSV(out, bytes.NewReader(buf.Bytes()), "person", CSVOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	const want = "id,name,active,photo\n" +
+		"1,Ann,true,AQI=\n" +
+		"2,\"Bob, Jr\",false,\n"
+	if out.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+	out.Reset()
+	if err := ToCSV(out, bytes.NewReader(buf.Bytes()), "person", CSVOptions{Hidden: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "id,name,active,photo,secret\n1,Ann,true,AQI=,s1\n") {
+		t.Fatalf("unexpected output with hidden columns:\n%s", out.String())
+	}
+
+	// Dropping the hidden column keeps the columns written without hidden
+	// columns and changes the columns written with them.
+	buf.Reset()
+	w = NewWriter(buf)
+	person, err := FromCSV(w, strings.NewReader(src), Table{Name: "person"}, cols...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	person = w.Redefine(person, cols[:4]...)
+	w.Insert(person, 3, "Cy", true, nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+	out.Reset()
+	if err := ToCSV(out, bytes.NewReader(stream), "person", CSVOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := want + "3,Cy,true,\n"; out.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+	const changed = `ts: columns of table "person" change in the stream`
+	if err := ToCSV(&bytes.Buffer{}, bytes.NewReader(stream), "person", CSVOptions{Hidden: true}); err == nil || err.Error() != changed {
+		t.Fatalf("got error %v, want %q", err, changed)
+	}
+
+	list := []struct {
+		src string
+		err string
+	}{
+		{"id,name\n1,Ann\nx,Bob\n", `ts: csv line 3 column "id": `},
+		{"id,other\n", `ts: csv line 1 column "other": not a column of table "person"`},
+		{"id,active\n1,maybe\n", `ts: csv line 2 column "active": `},
+		{"id,name\n1\n", `ts: csv line 2: `},
+	}
+	for _, item := range list {
+		w := NewWriter(&bytes.Buffer{})
+		_, err := FromCSV(w, strings.NewReader(item.src), Table{Name: "person"}, cols...)
+		if _, ok := err.(*CSVError); !ok || !strings.HasPrefix(err.Error(), item.err) {
+			t.Errorf("for %q got error %v, want %q", item.src, err, item.err)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	flag := w.DefineTag("flag")
+	team := w.Define(Table{Name: "team", Tags: Tags{flag}},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "name", Type: String, Comment: "Team name."},
+	)
+	person := w.Define(Table{Name: "person"},
+		Col{Name: "id", Type: Int64, Key: true},
+		Col{Name: "team", Type: Int64, Link: team.ID()},
+		Col{Name: "name", Type: String, Tags: Tags{flag}},
+		Col{Name: "active", Type: Bool, Default: Zero},
+		Col{Name: "photo", Type: Bytes, Nullable: true},
+		Col{Name: "sum", Type: Hash, Nullable: true},
+		Col{Name: "extra", Type: Any, Nullable: true},
+		Col{Name: "big", Type: Int64, Default: int64(7)},
+	)
+	var h [32]byte
+	h[0], h[31] = 1, 2
+	red := w.Insert(team, 1, "red")
+	w.Insert(person, 1, red, "Ann", true, []byte{1, 2}, h, "x", int64(1)<<60)
+	w.Insert(person.Use("id", "team", "name", "extra"), 2, red, "Bob", int64(-3))
+	w.Update(person.Use("name", "photo"), 2, "Bo", nil)
+	w.Delete(person, 1)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := ToJSON(out, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{
+		`{"table":"team","values":{"id":1,"name":"red"}}`,
+		`{"table":"person","values":{"id":1,"team":1,"name":"Ann","active":true,"photo":"AQI=","sum":"AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAI=","extra":{"type":"string","value":"x"},"big":"1152921504606846976"}}`,
+		`{"table":"person","values":{"id":2,"team":1,"name":"Bob","active":false,"photo":null,"sum":null,"extra":{"type":"int64","value":-3},"big":7}}`,
+		`{"table":"person","kind":"update","values":{"id":2,"name":"Bo","photo":null}}`,
+		`{"table":"person","kind":"delete","values":{"id":1}}`,
+	}
+	if len(lines) != len(want)+1 || !strings.HasPrefix(lines[0], `{"tables":[`) {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	for i, line := range lines[1:] {
+		if line != want[i] {
+			t.Errorf("line %d:\ngot  %s\nwant %s", i+2, line, want[i])
+		}
+	}
+
+	buf2 := &bytes.Buffer{}
+	w = NewWriter(buf2)
+	if err := FromJSON(w, bytes.NewReader(out.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out2 := &bytes.Buffer{}
+	if err := ToJSON(out2, bytes.NewReader(buf2.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != out2.String() {
+		t.Fatalf("round trip differs:\n%s\nwant:\n%s", out2.String(), out.String())
+	}
+
+	list := []struct {
+		src string
+		err string
+	}{
+		{`{"table":"team","values":{"id":1}}`, `ts: json document 1: table "team" not defined`},
+		{lines[0] + "\n" + `{"table":"team","values":{"id":1,"color":"red"}}`, `ts: json document 2: unknown column team.color`},
+		{lines[0] + "\n" + `{"table":"team","values":{"id":"x"}}`, `ts: json document 2: column team.id: `},
+		{`{"tables":[{"name":"t","columns":[{"name":"a","type":"float"}]}]}`, `ts: json document 1: column t.a has unknown type "float"`},
+	}
+	for _, item := range list {
+		w := NewWriter(&bytes.Buffer{})
+		err := FromJSON(w, strings.NewReader(item.src))
+		if err == nil || !strings.HasPrefix(err.Error(), item.err) {
+			t.Errorf("for %q got error %v, want %q", item.src, err, item.err)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tsgen generates typed Go bindings for ts tables.
+//
+// For each table a row struct, a table type with an Insert method and
+// a cursor type with a Scan method are generated. The generated code uses
+// ts.RowEncoder and ts.RowDecoder, so values are encoded without
+// interface conversions and a column type change fails to compile.
+//
+// Tags and links are written by name, so the generated definitions may be
+// used with any Writer that defines the linked tables first.
+package tsgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/solidcoredata/dca/ts"
+	"github.com/solidcoredata/dca/ts/tstext"
+)
+
+// Schema holds table definitions and the names of the tags and tables
+// they refer to by ID.
+type Schema struct {
+	Tables []ts.TableDef
+	Tags   map[ts.Tag]string // Tag names by tag.
+	Names  map[int64]string  // Table names by table ID.
+}
+
+// ReadSchema returns the table definitions found in the control tables
+// of the ts stream.
+func ReadSchema(r io.Reader) (*Schema, error) {
+	tr := ts.NewReader(r)
+	for tr.Next() {
+	}
+	if err := tr.Err(); err != nil {
+		return nil, err
+	}
+	s := &Schema{
+		Tables: tr.Tables(),
+		Tags:   make(map[ts.Tag]string),
+		Names:  make(map[int64]string),
+	}
+	addTags := func(tags ts.Tags) {
+		for _, tag := range tags {
+			if name := tr.TagName(tag); len(name) > 0 {
+				s.Tags[tag] = name
+			}
+		}
+	}
+	for _, t := range s.Tables {
+		s.Names[t.ID] = t.Name
+		addTags(t.Tags)
+		for _, c := range t.Columns {
+			addTags(c.Tags)
+		}
+	}
+	return s, nil
+}
+
+// ParseSchema returns the table definitions written in the let notation
+// of package tstext. Rows are ignored.
+func ParseSchema(filename string, src string) (*Schema, error) {
+	lets, err := tstext.Parse(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	for i := range lets {
+		lets[i].Rows, lets[i].Kinds = nil, nil
+	}
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	if err := tstext.Encode(w, lets); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return ReadSchema(buf)
+}
+
+// Generate returns formatted Go source in package pkg for the tables
+// of the schema.
+func Generate(pkg string, s *Schema) ([]byte, error) {
+	data := genFile{Package: pkg}
+	goNames := make(map[string]string, len(s.Tables))
+	for _, t := range s.Tables {
+		tags, err := s.tagsLiteral(t.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("tsgen: table %q: %v", t.Name, err)
+		}
+		gt := genTable{
+			Name:    t.Name,
+			GoName:  goName(t.Name),
+			Comment: t.Comment,
+			Note:    oneLine(t.Comment),
+			Tags:    tags,
+		}
+		if len(gt.GoName) == 0 {
+			return nil, fmt.Errorf("tsgen: invalid table name %q", t.Name)
+		}
+		if prev, ok := goNames[gt.GoName]; ok {
+			return nil, fmt.Errorf("tsgen: tables %q and %q have the same Go name %s", prev, t.Name, gt.GoName)
+		}
+		goNames[gt.GoName] = t.Name
+		fields := make(map[string]bool, len(t.Columns))
+		for _, c := range t.Columns {
+			gc, err := s.newGenColumn(c)
+			if err != nil {
+				return nil, fmt.Errorf("tsgen: table %q: %v", t.Name, err)
+			}
+			if fields[gc.GoName] {
+				return nil, fmt.Errorf("tsgen: table %q has two columns with Go name %s", t.Name, gc.GoName)
+			}
+			fields[gc.GoName] = true
+			gt.Columns = append(gt.Columns, gc)
+			if c.Link != 0 {
+				data.Links = true
+			}
+		}
+		data.Tables = append(data.Tables, gt)
+	}
+	buf := &bytes.Buffer{}
+	if err := fileTemplate.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("tsgen: format generated source: %v", err)
+	}
+	return src, nil
+}
+
+type genFile struct {
+	Package string
+	Tables  []genTable
+	Links   bool // A column links to a table.
+}
+
+type genTable struct {
+	Name    string
+	GoName  string
+	Comment string
+	Note    string // Single line comment.
+	Tags    string
+	Columns []genColumn
+}
+
+type genColumn struct {
+	ts.Col
+	GoName  string
+	GoType  string
+	Method  string // RowEncoder and RowDecoder method.
+	Pointer bool   // Field is a pointer to hold a null value.
+	Literal string // ts.Col composite literal.
+	Note    string // Single line comment.
+}
+
+// oneLine joins the lines of a comment so it fits in a line comment.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// initialisms are written in upper case when they form a whole word of a name.
+var initialisms = map[string]bool{
+	"id":   true,
+	"url":  true,
+	"uri":  true,
+	"http": true,
+	"json": true,
+	"xml":  true,
+	"sql":  true,
+	"uuid": true,
+	"api":  true,
+}
+
+// goName converts a table or column name such as "control/column_tag" into
+// an exported Go identifier such as "ControlColumnTag".
+func goName(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	b := &strings.Builder{}
+	for _, w := range words {
+		if initialisms[strings.ToLower(w)] {
+			b.WriteString(strings.ToUpper(w))
+			continue
+		}
+		rr := []rune(w)
+		rr[0] = unicode.ToUpper(rr[0])
+		b.WriteString(string(rr))
+	}
+	s := b.String()
+	if len(s) > 0 && unicode.IsDigit([]rune(s)[0]) {
+		s = "T" + s
+	}
+	return s
+}
+
+func (s *Schema) newGenColumn(c ts.Col) (genColumn, error) {
+	gc := genColumn{
+		Col:    c,
+		GoName: goName(c.Name),
+		Note:   oneLine(c.Comment),
+	}
+	if len(gc.GoName) == 0 {
+		return gc, fmt.Errorf("invalid column name %q", c.Name)
+	}
+	switch c.Type {
+	default:
+		return gc, fmt.Errorf("column %q has unknown type %v", c.Name, c.Type)
+	case ts.Hash:
+		gc.GoType, gc.Method = "[32]byte", "Hash"
+	case ts.Int64:
+		gc.GoType, gc.Method = "int64", "Int64"
+	case ts.Bool:
+		gc.GoType, gc.Method = "bool", "Bool"
+	case ts.String:
+		gc.GoType, gc.Method = "string", "String"
+	case ts.Bytes:
+		gc.GoType, gc.Method = "[]byte", "Bytes"
+	case ts.Any:
+		gc.GoType, gc.Method = "interface{}", "Any"
+	}
+	if c.Nullable && c.Type != ts.Bytes && c.Type != ts.Any {
+		gc.Pointer = true
+	}
+	lit, err := s.colLiteral(c)
+	if err != nil {
+		return gc, fmt.Errorf("column %q: %v", c.Name, err)
+	}
+	gc.Literal = lit
+	return gc, nil
+}
+
+func (s *Schema) colLiteral(c ts.Col) (string, error) {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "{Name: %q, Type: ts.%s", c.Name, typeName(c.Type))
+	if c.Link != 0 {
+		name, ok := s.Names[c.Link]
+		if !ok {
+			return "", fmt.Errorf("link to unknown table %d", c.Link)
+		}
+		fmt.Fprintf(b, ", Link: tableID(w, %q)", name)
+	}
+	if c.Key {
+		b.WriteString(", Key: true")
+	}
+	if c.Nullable {
+		b.WriteString(", Nullable: true")
+	}
+	if c.Length != 0 {
+		fmt.Fprintf(b, ", Length: %d", c.Length)
+	}
+	if c.SortOrder != 0 {
+		fmt.Fprintf(b, ", SortOrder: %d", c.SortOrder)
+	}
+	if c.Default != nil {
+		d, err := valueLiteral(c.Default)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(b, ", Default: %s", d)
+	}
+	if len(c.Comment) > 0 {
+		fmt.Fprintf(b, ", Comment: %q", c.Comment)
+	}
+	if len(c.Tags) > 0 {
+		tags, err := s.tagsLiteral(c.Tags)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(b, ", Tags: %s", tags)
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+func typeName(t ts.Type) string {
+	switch t {
+	case ts.Hash:
+		return "Hash"
+	case ts.Int64:
+		return "Int64"
+	case ts.Bool:
+		return "Bool"
+	case ts.String:
+		return "String"
+	case ts.Bytes:
+		return "Bytes"
+	case ts.Any:
+		return "Any"
+	}
+	return fmt.Sprintf("Type(%d)", int64(t))
+}
+
+func valueLiteral(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case int64:
+		return fmt.Sprintf("int64(%d)", x), nil
+	case bool, string:
+		return fmt.Sprintf("%#v", x), nil
+	case []byte:
+		return fmt.Sprintf("%#v", x), nil
+	case [32]byte:
+		return fmt.Sprintf("%#v", x), nil
+	}
+	if v == ts.Zero {
+		return "ts.Zero", nil
+	}
+	return "", fmt.Errorf("unsupported default value %#v", v)
+}
+
+// tagsLiteral returns the tags as a ts.Tags composite literal that defines
+// the tags in w by name.
+func (s *Schema) tagsLiteral(tags ts.Tags) (string, error) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	ss := make([]string, len(tags))
+	for i, t := range tags {
+		if t == ts.TagHidden {
+			ss[i] = "ts.TagHidden"
+			continue
+		}
+		name, ok := s.Tags[t]
+		if !ok {
+			return "", fmt.Errorf("unknown tag %d", t)
+		}
+		ss[i] = fmt.Sprintf("w.DefineTag(%q)", name)
+	}
+	return "ts.Tags{" + strings.Join(ss, ", ") + "}", nil
+}
+
+var fileTemplate = template.Must(template.New("file").Parse(`// Code generated by tsgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"github.com/solidcoredata/dca/ts"
+)
+{{if .Links}}
+// tableID returns the ID of the named table defined in w, or zero.
+func tableID(w *ts.Writer, name string) int64 {
+	t, _ := w.Lookup(name)
+	return t.ID()
+}
+{{end}}{{range .Tables}}
+// {{.GoName}} is a row of table {{printf "%q" .Name}}.{{if .Note}}
+//
+// {{.Note}}{{end}}
+type {{.GoName}} struct {
+{{- range .Columns}}
+	{{.GoName}} {{if .Pointer}}*{{end}}{{.GoType}} ` + "`" + `ts:"{{.Name}}"` + "`" + `{{if .Note}} // {{.Note}}{{end}}
+{{- end}}
+}
+
+// {{.GoName}}Def returns the definition of table {{printf "%q" .Name}}
+// with its tags defined in w and links to the tables of w.
+func {{.GoName}}Def(w *ts.Writer) ts.TableDef {
+	return ts.TableDef{
+		Table: ts.Table{Name: {{printf "%q" .Name}}{{if .Comment}}, Comment: {{printf "%q" .Comment}}{{end}}{{if .Tags}}, Tags: {{.Tags}}{{end}}},
+		Columns: []ts.Col{
+		{{- range .Columns}}
+			{{.Literal}},
+		{{- end}}
+		},
+	}
+}
+
+// {{.GoName}}Table is table {{printf "%q" .Name}} defined in a ts.Writer.
+type {{.GoName}}Table struct {
+	ref ts.TableRef
+}
+
+// Define{{.GoName}} defines table {{printf "%q" .Name}} in w.
+func Define{{.GoName}}(w *ts.Writer) {{.GoName}}Table {
+	def := {{.GoName}}Def(w)
+	return {{.GoName}}Table{ref: w.Define(def.Table, def.Columns...)}
+}
+
+// Ref returns the table reference.
+func (t {{.GoName}}Table) Ref() ts.TableRef {
+	return t.ref
+}
+
+// Insert encodes row into the table.
+func (t {{.GoName}}Table) Insert(w *ts.Writer, row *{{.GoName}}) ts.RowRef {
+	e := w.EncodeRow(t.ref)
+{{- range .Columns}}
+{{- if .Pointer}}
+	if row.{{.GoName}} == nil {
+		e.Null()
+	} else {
+		e.{{.Method}}(*row.{{.GoName}})
+	}
+{{- else}}
+	e.{{.Method}}(row.{{.GoName}})
+{{- end}}
+{{- end}}
+	return e.Done()
+}
+
+// {{.GoName}}Cursor reads the rows of table {{printf "%q" .Name}}.
+type {{.GoName}}Cursor struct {
+	*ts.Cursor
+}
+
+// Read{{.GoName}} returns a cursor over table {{printf "%q" .Name}} in r.
+func Read{{.GoName}}(r *ts.Reader) {{.GoName}}Cursor {
+	return {{.GoName}}Cursor{Cursor: r.Cursor({{printf "%q" .Name}})}
+}
+
+// Scan decodes the current row into row.
+func (c {{.GoName}}Cursor) Scan(row *{{.GoName}}) error {
+	d := c.DecodeRow()
+	d.Match({{range $i, $c := .Columns}}{{if $i}}, {{end}}{{printf "%q" $c.Name}}{{end}})
+{{- range .Columns}}
+{{- if .Pointer}}
+	if v, ok := d.{{.Method}}(); ok {
+		row.{{.GoName}} = &v
+	} else {
+		row.{{.GoName}} = nil
+	}
+{{- else}}
+	row.{{.GoName}}, _ = d.{{.Method}}()
+{{- end}}
+{{- end}}
+	return d.Err()
+}
+{{end}}`))
@@ -0,0 +1,200 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsgen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+func TestGenerate(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	w.Define(ts.Table{Name: "order_line"},
+		ts.Col{Name: "id", Type: ts.Int64, Key: true},
+		ts.Col{Name: "sku", Type: ts.String, Length: 20},
+		ts.Col{Name: "note", Type: ts.String, Nullable: true},
+	)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := ReadSchema(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Generate("model", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"type OrderLine struct {",
+		"ID   int64   `ts:\"id\"`",
+		"Note *string `ts:\"note\"`",
+		"func DefineOrderLine(w *ts.Writer) OrderLineTable {",
+		"func (c OrderLineCursor) Scan(row *OrderLine) error {",
+	} {
+		if !strings.Contains(string(src), want) {
+			t.Errorf("generated source missing %q:\n%s", want, src)
+		}
+	}
+}
+
+const compileSchema = `
+let team table :readonly {
+	id int64 key
+	name string
+}
+let person table {
+	id int64 key
+	team *team
+	email string nullable :pii :hidden
+}
+`
+
+// compileMain uses the generated bindings with a writer that checks
+// integrity and reads the rows back.
+const compileMain = `package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	w.CheckIntegrity(true)
+	w.DefineTag("other") // Tag IDs differ from the schema.
+	team := DefineTeam(w)
+	person := DefinePerson(w)
+	team.Insert(w, &Team{ID: 1, Name: "red"})
+	email := "ann@example.com"
+	person.Insert(w, &Person{ID: 1, Team: 1, Email: &email})
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	r := ts.NewReader(buf)
+	c := ReadPerson(r)
+	var got []string
+	for c.Next() {
+		var p Person
+		if err := c.Scan(&p); err != nil {
+			return err
+		}
+		got = append(got, fmt.Sprintf("%d %d %s", p.ID, p.Team, *p.Email))
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	for _, def := range r.Tables() {
+		var names []string
+		for _, tag := range def.Tags {
+			names = append(names, r.TagName(tag))
+		}
+		for _, col := range def.Columns {
+			for _, tag := range col.Tags {
+				names = append(names, col.Name+":"+r.TagName(tag))
+			}
+		}
+		got = append(got, fmt.Sprintf("%s %v", def.Name, names))
+	}
+
+	// The generated Insert rejects the same strings as Insert.
+	for _, name := range []string{"red", "\uFFFD", "a\xffb"} {
+		var errs [2]string
+		for i := range errs {
+			w := ts.NewWriter(&bytes.Buffer{})
+			team := DefineTeam(w)
+			if i == 0 {
+				team.Insert(w, &Team{ID: 1, Name: name})
+			} else {
+				w.Insert(team.Ref(), 1, name)
+			}
+			errs[i] = fmt.Sprint(w.Error())
+		}
+		if errs[0] != errs[1] {
+			return fmt.Errorf("for %+q generated Insert error %s, Insert error %s", name, errs[0], errs[1])
+		}
+		got = append(got, fmt.Sprintf("%+q:%t", name, errs[0] != "<nil>"))
+	}
+	fmt.Println(got)
+	return nil
+}
+`
+
+func TestGenerateCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go run in short mode")
+	}
+	gotool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	schema, err := ParseSchema("schema.ts", compileSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Generate("main", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), `w.DefineTag("pii")`) {
+		t.Fatalf("generated source does not define tags by name:\n%s", src)
+	}
+
+	// The package must be in the module to import ts.
+	dir, err := ioutil.TempDir(".", "_gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "model_ts.go"), src, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(compileMain), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(gotool, "run", "./"+filepath.Base(dir)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run: %v\n%s\ngenerated source:\n%s", err, out, src)
+	}
+	const want = `[1 1 ann@example.com team [readonly] person [email:pii email:hidden] "red":false "\ufffd":true "a\xffb":true]` + "\n"
+	if string(out) != want {
+		t.Fatalf("got output %q, want %q", out, want)
+	}
+}
+
+func TestGoName(t *testing.T) {
+	list := []struct{ name, want string }{
+		{"id", "ID"},
+		{"control/column/tag", "ControlColumnTag"},
+		{"order_line", "OrderLine"},
+		{"site_url", "SiteURL"},
+		{"2fa", "T2fa"},
+	}
+	for _, item := range list {
+		if got := goName(item.name); got != item.want {
+			t.Errorf("goName(%q) = %q, want %q", item.name, got, item.want)
+		}
+	}
+}
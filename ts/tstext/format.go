@@ -0,0 +1,253 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstext
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+// FormatOptions control the output of Format.
+type FormatOptions struct {
+	Control bool // Include the control tables.
+	Hidden  bool // Include columns tagged hidden.
+}
+
+// Format reads the ts stream from in and writes every table in the let
+// notation to out, ordered by table ID. Rows are written in stream order.
+// Each row lists every written column, using null for columns without a value.
+// Update and delete rows use "_" for columns they do not set.
+// A table redefined in the stream is written once for each version in
+// stream order, each followed by the rows written with that version.
+//
+// All rows are held in memory until the end of the stream.
+func Format(out io.Writer, in io.Reader, opt FormatOptions) error {
+	r := ts.NewReader(in)
+	r.ShowControl(opt.Control)
+	blocks := make(map[string][]*formatBlock)
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			return err
+		}
+		if kind := r.Kind(); kind != ts.RowData {
+			for i, set := range r.Changed() {
+				if !set {
+					values[i] = Unset
+				}
+			}
+		}
+		name := r.Table().Name
+		list := blocks[name]
+		var b *formatBlock
+		if n := len(list); n > 0 && list[n-1].version == r.Version() {
+			b = list[n-1]
+		} else {
+			b = &formatBlock{
+				def:     ts.TableDef{Table: r.Table(), Columns: r.Columns()},
+				version: r.Version(),
+			}
+			blocks[name] = append(list, b)
+		}
+		b.rows = append(b.rows, formatRow{Kind: r.Kind(), Values: values})
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	tables := r.Tables()
+	tableName := make(map[int64]string, len(tables))
+	for _, t := range tables {
+		tableName[t.ID] = t.Name
+	}
+	bw := bufio.NewWriter(out)
+	first := true
+	for _, t := range tables {
+		list := blocks[t.Name]
+		if n := len(list); n == 0 || !sameDef(list[n-1].def, t) {
+			// The table has no rows with its last definition.
+			list = append(list, &formatBlock{def: t})
+		}
+		for _, b := range list {
+			if !first {
+				bw.WriteString("\n")
+			}
+			first = false
+			if err := formatTable(bw, b.def, b.rows, tableName, r.TagName, opt); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// formatBlock is a version of a table and the rows written with it.
+type formatBlock struct {
+	def     ts.TableDef
+	version [32]byte
+	rows    []formatRow
+}
+
+// sameDef reports whether a and b define the same table and columns.
+func sameDef(a, b ts.TableDef) bool {
+	return reflect.DeepEqual(a.Table, b.Table) && reflect.DeepEqual(a.Columns, b.Columns)
+}
+
+type formatRow struct {
+	Kind   ts.RowKind
+	Values []interface{}
+}
+
+func formatTable(w *bufio.Writer, t ts.TableDef, rows []formatRow, tableName map[int64]string, tagName func(ts.Tag) string, opt FormatOptions) error {
+	show := make([]bool, len(t.Columns))
+	for i, c := range t.Columns {
+		show[i] = opt.Hidden || !hasTag(c.Tags, ts.TagHidden)
+	}
+
+	if len(t.Comment) > 0 {
+		for _, line := range strings.Split(t.Comment, "\n") {
+			w.WriteString(strings.TrimSpace("// " + oneLine(line)))
+			w.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(w, "let %s table", t.Name)
+	writeTags(w, t.Tags, tagName)
+	w.WriteString(" {\n")
+	for i, c := range t.Columns {
+		if !show[i] {
+			continue
+		}
+		fmt.Fprintf(w, "\t%s ", c.Name)
+		if c.Link != 0 {
+			name, ok := tableName[c.Link]
+			if !ok {
+				return fmt.Errorf("tstext: column %s.%s links to unknown table %d", t.Name, c.Name, c.Link)
+			}
+			fmt.Fprintf(w, "*%s", name)
+		} else {
+			w.WriteString(typeName(c.Type))
+		}
+		if c.Key {
+			w.WriteString(" key")
+		}
+		if c.Nullable {
+			w.WriteString(" nullable")
+		}
+		if c.Default != nil {
+			w.WriteString(" default ")
+			w.WriteString(formatValue(c.Default))
+		}
+		if c.Length != 0 {
+			fmt.Fprintf(w, " length=%d", c.Length)
+		}
+		writeTags(w, c.Tags, tagName)
+		if len(c.Comment) > 0 {
+			fmt.Fprintf(w, " // %s", oneLine(c.Comment))
+		}
+		w.WriteString("\n")
+	}
+	w.WriteString("}")
+	if len(rows) == 0 {
+		w.WriteString("\n")
+		return nil
+	}
+	w.WriteString(" {\n")
+	for _, row := range rows {
+		w.WriteString("\t")
+		if row.Kind != ts.RowData {
+			w.WriteString(row.Kind.String())
+			w.WriteString(" ")
+		}
+		w.WriteString("{")
+		first := true
+		for i, v := range row.Values {
+			if !show[i] {
+				continue
+			}
+			if !first {
+				w.WriteString(", ")
+			}
+			first = false
+			w.WriteString(formatValue(v))
+		}
+		w.WriteString("},\n")
+	}
+	w.WriteString("}\n")
+	return nil
+}
+
+func hasTag(tags ts.Tags, tag ts.Tag) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeTags(w *bufio.Writer, tags ts.Tags, tagName func(ts.Tag) string) {
+	for _, tag := range tags {
+		w.WriteString(" :")
+		if name := tagName(tag); len(name) > 0 {
+			w.WriteString(name)
+			continue
+		}
+		w.WriteString("tag" + strconv.FormatInt(int64(tag), 10))
+	}
+}
+
+func typeName(t ts.Type) string {
+	for name, tt := range typeNames {
+		if tt == t && name != "int" {
+			return name
+		}
+	}
+	return t.String()
+}
+
+// formatValue returns the literal for v that Parse reads back.
+func formatValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case bool:
+		return strconv.FormatBool(x)
+	case string:
+		return strconv.Quote(x)
+	case []byte:
+		if len(x) == 0 {
+			return `""`
+		}
+		return "0x" + hex.EncodeToString(x)
+	case [32]byte:
+		return "0x" + hex.EncodeToString(x[:])
+	}
+	switch v {
+	case ts.Zero:
+		return "zero"
+	case Unset:
+		return "_"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func oneLine(s string) string {
+	b := []rune(s)
+	for i, r := range b {
+		if r == '\n' || r == '\r' {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,550 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstext
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/scanner"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+// Let is a single let statement: a table definition with optional rows.
+type Let struct {
+	Table   ts.Table
+	Columns []ts.Col
+
+	// Links holds the name of the table each column links to,
+	// or an empty string if the column is not a link.
+	Links []string
+
+	// Rows holds the row values in column order. Trailing columns
+	// without a value are nil. Columns an update or delete row does
+	// not set hold Unset.
+	Rows [][]interface{}
+
+	// Kinds holds the kind of each row.
+	Kinds []ts.RowKind
+
+	// TagNames holds the names of the tags used by the table and columns
+	// that are not predefined. Encode defines these tags in the Writer.
+	TagNames map[ts.Tag]string
+
+	Pos scanner.Position
+}
+
+var typeNames = map[string]ts.Type{
+	"hash":   ts.Hash,
+	"int64":  ts.Int64,
+	"int":    ts.Int64,
+	"bool":   ts.Bool,
+	"string": ts.String,
+	"bytes":  ts.Bytes,
+	"any":    ts.Any,
+}
+
+// tagNames are the predefined tags. Other tag names are numbered
+// in the order they appear.
+var tagNames = map[string]ts.Tag{
+	"hidden": ts.TagHidden,
+}
+
+type unset struct{}
+
+// Unset is the value of a column an update or delete row does not set.
+// It is written as "_".
+var Unset = unset{}
+
+// rowKinds are the words that may start an update or delete row.
+var rowKinds = map[string]ts.RowKind{
+	"update": ts.RowUpdate,
+	"delete": ts.RowDelete,
+}
+
+type parser struct {
+	s   scanner.Scanner
+	tok rune
+	err error
+
+	comment     string // Text of the last comment.
+	commentLine int    // Line of the last comment.
+	tokLine     int    // Line of the last token that is not a comment.
+
+	doc     []string // Lines of the last block of comments on their own lines.
+	docLine int      // Line of the last comment in doc.
+
+	tags    map[string]ts.Tag // Tags that are not predefined.
+	nextTag ts.Tag
+}
+
+type parseError struct {
+	pos scanner.Position
+	msg string
+}
+
+func (e parseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.pos, e.msg)
+}
+
+// Parse parses the let statements in src. The filename is used in
+// error positions.
+func Parse(filename string, src string) ([]Let, error) {
+	p := &parser{
+		tags:    make(map[string]ts.Tag),
+		nextTag: ts.TagHidden,
+	}
+	p.s.Init(strings.NewReader(src))
+	p.s.Filename = filename
+	p.s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments
+	p.s.Whitespace = 1<<'\t' | 1<<'\r' | 1<<' '
+	p.s.Error = func(s *scanner.Scanner, msg string) {
+		p.fail(s.Position, msg)
+	}
+	p.next()
+
+	var lets []Let
+	for {
+		p.skipNewlines()
+		if p.tok == scanner.EOF || p.err != nil {
+			break
+		}
+		l, ok := p.parseLet()
+		if !ok {
+			break
+		}
+		lets = append(lets, l)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return lets, nil
+}
+
+func (p *parser) next() {
+	p.tok = p.s.Scan()
+	for p.tok == scanner.Comment {
+		text := p.s.TokenText()
+		if strings.HasPrefix(text, "//") {
+			line := p.s.Position.Line
+			p.comment = strings.TrimSpace(strings.TrimPrefix(text, "//"))
+			p.commentLine = line
+			if line > p.tokLine {
+				if line != p.docLine+1 {
+					p.doc = p.doc[:0]
+				}
+				p.doc = append(p.doc, p.comment)
+				p.docLine = line
+			}
+		}
+		p.tok = p.s.Scan()
+	}
+	p.tokLine = p.s.Position.Line
+}
+
+func (p *parser) fail(pos scanner.Position, format string, v ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	if !pos.IsValid() {
+		pos = p.s.Position
+	}
+	p.err = parseError{pos: pos, msg: fmt.Sprintf(format, v...)}
+}
+
+func (p *parser) skipNewlines() {
+	for p.tok == '\n' || p.tok == ',' {
+		p.next()
+	}
+}
+
+func (p *parser) expect(tok rune) bool {
+	if p.tok != tok {
+		p.fail(p.s.Position, "expected %s, found %q", scanner.TokenString(tok), p.s.TokenText())
+		return false
+	}
+	p.next()
+	return true
+}
+
+func (p *parser) keyword(kw string) bool {
+	if p.tok != scanner.Ident || p.s.TokenText() != kw {
+		p.fail(p.s.Position, "expected %q, found %q", kw, p.s.TokenText())
+		return false
+	}
+	p.next()
+	return true
+}
+
+// name parses a table or column name made of identifiers separated by "/" or ".".
+func (p *parser) name() (string, bool) {
+	if p.tok != scanner.Ident {
+		p.fail(p.s.Position, "expected name, found %q", p.s.TokenText())
+		return "", false
+	}
+	b := &strings.Builder{}
+	b.WriteString(p.s.TokenText())
+	p.next()
+	for p.tok == '/' || p.tok == '.' {
+		b.WriteRune(p.tok)
+		p.next()
+		if p.tok != scanner.Ident {
+			p.fail(p.s.Position, "expected name, found %q", p.s.TokenText())
+			return "", false
+		}
+		b.WriteString(p.s.TokenText())
+		p.next()
+	}
+	return b.String(), true
+}
+
+// tag parses ":name" and records the name in l.
+func (p *parser) tag(l *Let) (ts.Tag, bool) {
+	if !p.expect(':') {
+		return 0, false
+	}
+	if p.tok != scanner.Ident {
+		p.fail(p.s.Position, "expected tag name, found %q", p.s.TokenText())
+		return 0, false
+	}
+	name := p.s.TokenText()
+	p.next()
+	if tag, ok := tagNames[name]; ok {
+		return tag, true
+	}
+	tag, ok := p.tags[name]
+	if !ok {
+		p.nextTag++
+		tag = p.nextTag
+		p.tags[name] = tag
+	}
+	if l.TagNames == nil {
+		l.TagNames = make(map[ts.Tag]string)
+	}
+	l.TagNames[tag] = name
+	return tag, true
+}
+
+func (p *parser) parseLet() (Let, bool) {
+	l := Let{Pos: p.s.Position}
+	if len(p.doc) > 0 && p.docLine == l.Pos.Line-1 {
+		l.Table.Comment = strings.Join(p.doc, "\n")
+	}
+	if !p.keyword("let") {
+		return l, false
+	}
+	name, ok := p.name()
+	if !ok {
+		return l, false
+	}
+	l.Table.Name = name
+	if !p.keyword("table") {
+		return l, false
+	}
+	for p.tok == ':' {
+		tag, ok := p.tag(&l)
+		if !ok {
+			return l, false
+		}
+		l.Table.Tags = append(l.Table.Tags, tag)
+	}
+	if !p.expect('{') {
+		return l, false
+	}
+	for {
+		p.skipNewlines()
+		if p.tok == '}' {
+			p.next()
+			break
+		}
+		col, link, ok := p.parseColumn(&l)
+		if !ok {
+			return l, false
+		}
+		for _, c := range l.Columns {
+			if c.Name == col.Name {
+				p.fail(p.s.Position, "duplicate column %q in table %q", col.Name, l.Table.Name)
+				return l, false
+			}
+		}
+		l.Columns = append(l.Columns, col)
+		l.Links = append(l.Links, link)
+	}
+	if len(l.Columns) == 0 {
+		p.fail(l.Pos, "table %q has no columns", l.Table.Name)
+		return l, false
+	}
+
+	// Optional rows.
+	for p.tok == '\n' {
+		p.next()
+	}
+	if p.tok != '{' {
+		return l, true
+	}
+	p.next()
+	for {
+		p.skipNewlines()
+		if p.tok == '}' {
+			p.next()
+			break
+		}
+		kind := ts.RowData
+		if p.tok == scanner.Ident {
+			k, ok := rowKinds[p.s.TokenText()]
+			if !ok {
+				p.fail(p.s.Position, "unknown row kind %q", p.s.TokenText())
+				return l, false
+			}
+			kind = k
+			p.next()
+		}
+		row, ok := p.parseRow(&l, kind)
+		if !ok {
+			return l, false
+		}
+		l.Rows = append(l.Rows, row)
+		l.Kinds = append(l.Kinds, kind)
+	}
+	return l, true
+}
+
+// parseColumn parses a single column definition line:
+//
+//	name type [key] [nullable] [default value] [length=N] [:tag]
+//	name *table [nullable] ...
+func (p *parser) parseColumn(l *Let) (ts.Col, string, bool) {
+	var c ts.Col
+	var link string
+	line := p.s.Position.Line
+	name, ok := p.name()
+	if !ok {
+		return c, link, false
+	}
+	c.Name = name
+	if p.tok == '*' {
+		p.next()
+		link, ok = p.name()
+		if !ok {
+			return c, link, false
+		}
+		c.Type = ts.Int64
+	} else {
+		if p.tok != scanner.Ident {
+			p.fail(p.s.Position, "expected type for column %q, found %q", c.Name, p.s.TokenText())
+			return c, link, false
+		}
+		t, ok := typeNames[p.s.TokenText()]
+		if !ok {
+			p.fail(p.s.Position, "unknown type %q for column %q", p.s.TokenText(), c.Name)
+			return c, link, false
+		}
+		c.Type = t
+		p.next()
+	}
+	for p.tok != '\n' && p.tok != '}' && p.tok != scanner.EOF {
+		if p.tok == ':' {
+			tag, ok := p.tag(l)
+			if !ok {
+				return c, link, false
+			}
+			c.Tags = append(c.Tags, tag)
+			continue
+		}
+		if p.tok != scanner.Ident {
+			p.fail(p.s.Position, "unexpected %q in column %q", p.s.TokenText(), c.Name)
+			return c, link, false
+		}
+		opt := p.s.TokenText()
+		pos := p.s.Position
+		p.next()
+		switch opt {
+		default:
+			p.fail(pos, "unknown option %q for column %q", opt, c.Name)
+			return c, link, false
+		case "key":
+			c.Key = true
+		case "nullable":
+			c.Nullable = true
+		case "default":
+			v, ok := p.value(c.Type)
+			if !ok {
+				return c, link, false
+			}
+			c.Default = v
+		case "length":
+			if !p.expect('=') {
+				return c, link, false
+			}
+			v, ok := p.value(ts.Int64)
+			if !ok {
+				return c, link, false
+			}
+			c.Length = v.(int64)
+		}
+	}
+	if p.commentLine == line {
+		c.Comment = p.comment
+	}
+	return c, link, true
+}
+
+// parseRow parses "{value, value, ...}". Update and delete rows must set
+// every key column.
+func (p *parser) parseRow(l *Let, kind ts.RowKind) ([]interface{}, bool) {
+	pos := p.s.Position
+	if !p.expect('{') {
+		return nil, false
+	}
+	row := make([]interface{}, len(l.Columns))
+	i := 0
+	for {
+		for p.tok == '\n' {
+			p.next()
+		}
+		if p.tok == '}' {
+			p.next()
+			break
+		}
+		if i > 0 {
+			if !p.expect(',') {
+				return nil, false
+			}
+			for p.tok == '\n' {
+				p.next()
+			}
+			if p.tok == '}' {
+				p.next()
+				break
+			}
+		}
+		if i >= len(l.Columns) {
+			p.fail(p.s.Position, "too many values for table %q, expected %d", l.Table.Name, len(l.Columns))
+			return nil, false
+		}
+		if kind != ts.RowData && p.tok == scanner.Ident && p.s.TokenText() == "_" {
+			p.next()
+			row[i] = Unset
+			i++
+			continue
+		}
+		v, ok := p.value(l.Columns[i].Type)
+		if !ok {
+			return nil, false
+		}
+		row[i] = v
+		i++
+	}
+	if kind != ts.RowData {
+		for ; i < len(row); i++ {
+			row[i] = Unset
+		}
+		for i, c := range l.Columns {
+			if c.Key && (row[i] == Unset || row[i] == nil) {
+				p.fail(pos, "%v row missing key column %q of table %q", kind, c.Name, l.Table.Name)
+				return nil, false
+			}
+		}
+		return row, true
+	}
+	for ; i < len(l.Columns); i++ {
+		c := &l.Columns[i]
+		if !c.Nullable && c.Default == nil {
+			p.fail(pos, "missing value for column %q of table %q", c.Name, l.Table.Name)
+			return nil, false
+		}
+	}
+	for i, v := range row {
+		c := &l.Columns[i]
+		if v == nil && !c.Nullable && c.Default == nil {
+			p.fail(pos, "null value for column %q of table %q", c.Name, l.Table.Name)
+			return nil, false
+		}
+	}
+	return row, true
+}
+
+// value parses a literal for a column of type t. The literal null returns nil
+// and the literal zero returns ts.Zero.
+func (p *parser) value(t ts.Type) (interface{}, bool) {
+	pos := p.s.Position
+	neg := false
+	if p.tok == '-' {
+		neg = true
+		p.next()
+		if p.tok != scanner.Int {
+			p.fail(pos, "expected number after \"-\"")
+			return nil, false
+		}
+	}
+	text := p.s.TokenText()
+	tok := p.tok
+	p.next()
+	switch tok {
+	case scanner.Ident:
+		switch text {
+		case "null":
+			return nil, true
+		case "zero":
+			return ts.Zero, true
+		case "true", "false":
+			if t != ts.Bool && t != ts.Any {
+				break
+			}
+			return text == "true", true
+		}
+	case scanner.String, scanner.RawString:
+		if t != ts.String && t != ts.Bytes && t != ts.Any {
+			break
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			p.fail(pos, "invalid string %s: %v", text, err)
+			return nil, false
+		}
+		if t == ts.Bytes {
+			return []byte(s), true
+		}
+		return s, true
+	case scanner.Int:
+		isHex := strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X")
+		switch {
+		case t == ts.Int64 || (t == ts.Any && !isHex):
+			if neg {
+				text = "-" + text
+			}
+			v, err := strconv.ParseInt(text, 0, 64)
+			if err != nil {
+				p.fail(pos, "invalid integer %s: %v", text, err)
+				return nil, false
+			}
+			return v, true
+		case isHex && !neg && (t == ts.Bytes || t == ts.Hash || t == ts.Any):
+			digits := text[2:]
+			if len(digits)%2 != 0 {
+				digits = "0" + digits
+			}
+			b, err := hex.DecodeString(digits)
+			if err != nil {
+				p.fail(pos, "invalid hex %s: %v", text, err)
+				return nil, false
+			}
+			if t != ts.Hash {
+				return b, true
+			}
+			var h [32]byte
+			if len(b) > len(h) {
+				p.fail(pos, "hash %s longer than %d bytes", text, len(h))
+				return nil, false
+			}
+			copy(h[len(h)-len(b):], b)
+			return h, true
+		}
+	}
+	p.fail(pos, "invalid %v value %q", t, text)
+	return nil, false
+}
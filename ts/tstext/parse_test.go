@@ -0,0 +1,318 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstext
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+const teamText = `
+// Teams and their members.
+let team table {
+	id int64 key
+	name string length=100
+}{
+	{1, "Red"},
+	{2, "Blue"},
+}
+
+let person table {
+	id int64 key
+	name string :pii
+	team *team nullable
+	active bool default zero
+	secret bytes nullable :hidden
+} {
+	{1, "Ann", 1, true, 0x0102},
+	{2, "Bob"},
+}
+
+// Notes are free text.
+// Each note has a default text.
+let note table {
+	id int64 key
+	text string default "none"
+}
+`
+
+func TestParse(t *testing.T) {
+	lets, err := Parse("team.txt", teamText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lets) != 3 {
+		t.Fatalf("got %d lets, want 3", len(lets))
+	}
+	if got := lets[0].Table.Comment; got != "Teams and their members." {
+		t.Fatalf("got team comment %q", got)
+	}
+	if got := lets[1].Table.Comment; got != "" {
+		t.Fatalf("got person comment %q, want none", got)
+	}
+	if got, want := lets[2].Table.Comment, "Notes are free text.\nEach note has a default text."; got != want {
+		t.Fatalf("got note comment %q, want %q", got, want)
+	}
+	person := lets[1]
+	wantCols := []ts.Col{
+		{Name: "id", Type: ts.Int64, Key: true},
+		{Name: "name", Type: ts.String, Tags: ts.Tags{2}},
+		{Name: "team", Type: ts.Int64, Nullable: true},
+		{Name: "active", Type: ts.Bool, Default: ts.Zero},
+		{Name: "secret", Type: ts.Bytes, Nullable: true, Tags: ts.Tags{ts.TagHidden}},
+	}
+	if !reflect.DeepEqual(person.Columns, wantCols) {
+		t.Fatalf("got %v, want %v", person.Columns, wantCols)
+	}
+	if !reflect.DeepEqual(person.Links, []string{"", "", "team", "", ""}) {
+		t.Fatalf("unexpected links %q", person.Links)
+	}
+	if !reflect.DeepEqual(person.TagNames, map[ts.Tag]string{2: "pii"}) {
+		t.Fatalf("unexpected tag names %v", person.TagNames)
+	}
+
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	if err := Encode(w, lets); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := ts.NewReader(buf)
+	var got [][]interface{}
+	for r.Next() {
+		values, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, values)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{int64(1), "Red"},
+		{int64(2), "Blue"},
+		{int64(1), "Ann", int64(1), true, []byte{1, 2}},
+		{int64(2), "Bob", nil, false, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if link := r.Tables()[1].Columns[2].Link; link != r.Tables()[0].ID {
+		t.Fatalf("got link %d", link)
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	const src = `let n table {
+	v int64
+	a any
+} {
+	{-9223372036854775808, -9223372036854775808},
+	{9223372036854775807, -16},
+}
+`
+	lets, err := Parse("n.txt", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{int64(-1 << 63), int64(-1 << 63)},
+		{int64(1<<63 - 1), int64(-16)},
+	}
+	if !reflect.DeepEqual(lets[0].Rows, want) {
+		t.Fatalf("got %v, want %v", lets[0].Rows, want)
+	}
+
+	_, err = Parse("n.txt", "let n table {\n\tv int64\n} {\n\t{-9223372036854775809},\n}")
+	if err == nil || !strings.HasPrefix(err.Error(), "n.txt:4:3: invalid integer -9223372036854775809") {
+		t.Fatalf("got error %v, want out of range error", err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	list := []struct {
+		src string
+		err string
+	}{
+		{"let t table {\n\tid int32\n}", "t.txt:2:5: unknown type \"int32\""},
+		{"let t table {\n\tid int64\n} {\n\t{1, 2},\n}", "t.txt:4:6: too many values"},
+		{"let t table {\n\tid int64\n\tname string\n} {\n\t{1},\n}", "t.txt:5:2: missing value for column \"name\""},
+		{"let t table {\n\tid int64 :1\n}", "t.txt:2:12: expected tag name, found \"1\""},
+	}
+	for _, item := range list {
+		_, err := Parse("t.txt", item.src)
+		if err == nil || !strings.HasPrefix(err.Error(), item.err) {
+			t.Errorf("for %q got error %v, want %q", item.src, err, item.err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	lets, err := Parse("team.txt", teamText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	if err := Encode(w, lets); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+
+	out := &bytes.Buffer{}
+	if err := Format(out, bytes.NewReader(stream), FormatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	const want = `// Teams and their members.
+let team table {
+	id int64 key
+	name string length=100
+} {
+	{1, "Red"},
+	{2, "Blue"},
+}
+
+let person table {
+	id int64 key
+	name string :pii
+	team *team nullable
+	active bool default zero
+} {
+	{1, "Ann", 1, true},
+	{2, "Bob", null, false},
+}
+
+// Notes are free text.
+// Each note has a default text.
+let note table {
+	id int64 key
+	text string default "none"
+}
+`
+	if got := out.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	out.Reset()
+	if err := Format(out, bytes.NewReader(stream), FormatOptions{Hidden: true}); err != nil {
+		t.Fatal(err)
+	}
+	full := out.String()
+	if !strings.Contains(full, "// Notes are free text.\n// Each note has a default text.\nlet note table {") {
+		t.Fatalf("missing note comment in:\n%s", full)
+	}
+	again, err := Parse("format.txt", full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = &bytes.Buffer{}
+	w = ts.NewWriter(buf)
+	if err := Encode(w, again); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := Format(out, buf, FormatOptions{Hidden: true}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != full {
+		t.Fatalf("format after parse got:\n%s\nwant:\n%s", out.String(), full)
+	}
+
+	out.Reset()
+	if err := Format(out, bytes.NewReader(stream), FormatOptions{Control: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "let control/column table {\n\tid int64 key\n\ttable int64\n") {
+		t.Fatalf("missing control/column in:\n%s", out.String())
+	}
+}
+
+func TestFormatDelta(t *testing.T) {
+	const src = `let person table {
+	id int64 key
+	name string
+	email string nullable
+} {
+	{1, "Ann", "ann@example.com"},
+	update {1, "Anne", _},
+	update {1, _, null},
+	delete {1, _, _},
+}
+`
+	lets, err := Parse("delta.txt", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	if err := Encode(w, lets); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Format(out, buf, FormatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != src {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, src)
+	}
+}
+
+func TestFormatRedefine(t *testing.T) {
+	const src = `let person table {
+	id int64 key
+	name string
+	age int64
+} {
+	{1, "Ann", 30},
+}
+
+let person table {
+	id int64 key
+	age int64
+} {
+	{2, 40},
+}
+
+let person table {
+	id int64 key
+	age int64 nullable
+}
+`
+	lets, err := Parse("redefine.txt", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w := ts.NewWriter(buf)
+	if err := Encode(w, lets); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := Format(out, buf, FormatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != src {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, src)
+	}
+}
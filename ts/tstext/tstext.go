@@ -0,0 +1,130 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tstext reads table definitions and rows written in the let notation
+// of the ts package documentation:
+//
+//	let person table {
+//		id int64 key
+//		name string length=100
+//		team *team nullable
+//		active bool default zero
+//		secret bytes nullable :hidden :pii
+//	} {
+//		{1, "Ann", 1, true},
+//		{2, "Bob"},
+//	}
+//
+// A table may be followed by a block of rows. Values are written in
+// column order and trailing columns that are nullable or have a default
+// may be left out. Values are integers, Go quoted strings, true, false,
+// null, zero, and hex literals such as 0x0102 for hash and bytes columns.
+// A row may start with "update" or "delete" to write an update or delete row.
+// These rows must set the key columns and use "_" for the columns they do
+// not set.
+// Tags are written as ":name". Tags other than "hidden" are defined
+// in the Writer by Encode.
+// A table defined again by a later let is redefined with the new columns,
+// as by ts.Writer.Redefine.
+// A column of type "*name" links to the named table and holds its int64 ID.
+// Comments start with "//". A comment at the end of a column line is
+// the column comment. Comment lines directly before a let are the table
+// comment.
+package tstext
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/solidcoredata/dca/ts"
+)
+
+// Encode defines each table in w and inserts its rows.
+// Links are resolved to tables defined earlier in lets or already defined in w.
+// A table defined by an earlier let is redefined.
+func Encode(w *ts.Writer, lets []Let) error {
+	defined := make(map[string]ts.TableRef, len(lets))
+	for _, l := range lets {
+		table := l.Table
+		table.Tags = defineTags(w, l.TagNames, table.Tags)
+		cols := make([]ts.Col, len(l.Columns))
+		copy(cols, l.Columns)
+		for i := range cols {
+			cols[i].Tags = defineTags(w, l.TagNames, cols[i].Tags)
+		}
+		for i, link := range l.Links {
+			if len(link) == 0 {
+				continue
+			}
+			ref, ok := lookup(w, link)
+			if !ok {
+				return fmt.Errorf("%s: column %q links to unknown table %q", l.Pos, cols[i].Name, link)
+			}
+			cols[i].Link = ref.ID()
+		}
+		tref, ok := defined[table.Name]
+		if ok {
+			tref = w.Redefine(tref, cols...)
+		} else {
+			tref = w.Define(table, cols...)
+		}
+		defined[table.Name] = tref
+		for ri, row := range l.Rows {
+			kind := ts.RowData
+			if ri < len(l.Kinds) {
+				kind = l.Kinds[ri]
+			}
+			if kind == ts.RowData {
+				w.Insert(tref, row...)
+				continue
+			}
+			var key ts.Key
+			var names []string
+			var values []interface{}
+			for i, c := range cols {
+				switch {
+				case c.Key:
+					key = append(key, row[i])
+				case row[i] != Unset:
+					names = append(names, c.Name)
+					values = append(values, row[i])
+				}
+			}
+			if kind == ts.RowDelete {
+				w.Delete(tref, key)
+				continue
+			}
+			w.Update(tref.Use(names...), key, values...)
+		}
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("%s: table %q: %v", l.Pos, l.Table.Name, err)
+		}
+	}
+	return nil
+}
+
+// defineTags returns tags with each named tag replaced by the tag
+// defined in w.
+func defineTags(w *ts.Writer, names map[ts.Tag]string, tags ts.Tags) ts.Tags {
+	if len(names) == 0 || len(tags) == 0 {
+		return tags
+	}
+	out := make(ts.Tags, len(tags))
+	for i, tag := range tags {
+		out[i] = tag
+		if name, ok := names[tag]; ok {
+			out[i] = w.DefineTag(name)
+		}
+	}
+	return out
+}
+
+// lookup finds a table by name. The names "control.table" and
+// "control/table" refer to the same table.
+func lookup(w *ts.Writer, name string) (ts.TableRef, bool) {
+	if ref, ok := w.Lookup(name); ok {
+		return ref, true
+	}
+	return w.Lookup(strings.Replace(name, ".", "/", -1))
+}
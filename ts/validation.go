@@ -0,0 +1,143 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// RowValidation is a row that reports a problem with a row of the table.
+// Validation rows are not returned from Next, see Reader.Validations.
+const RowValidation RowKind = 'V'
+
+// Validation is a problem with a table, a row or a column of a row,
+// such as a rejected value in a request.
+type Validation struct {
+	Table string
+
+	// Row is the ID of the row as returned by Reader.RowID.
+	// Row is zero if the problem is not for a single row.
+	Row int64
+
+	// Column is empty if the problem is not for a single column.
+	Column string
+
+	Code    int64
+	Message string
+}
+
+func (v Validation) String() string {
+	s := v.Table
+	if v.Row != 0 {
+		s += fmt.Sprintf("[%d]", v.Row)
+	}
+	if len(v.Column) > 0 {
+		s += "." + v.Column
+	}
+	return fmt.Sprintf("%s: %d %s", s, v.Code, v.Message)
+}
+
+// Validate writes a validation row for table t. The row is zero for
+// a problem with the whole table. The column may be empty, otherwise it
+// must be a column of t.
+//
+// Validation rows are written in-band with the table rows, so a reply
+// may carry any number of them without failing the stream.
+func (w *Writer) Validate(t TableRef, row int64, column string, code int64, message string) {
+	if w.err != nil {
+		return
+	}
+	ti := w.table[t.id]
+	if ti == nil {
+		w.err = fmt.Errorf("ts: unknown table %d", t.id)
+		return
+	}
+	if len(column) > 0 && ti.ColumnByName[column] == nil {
+		w.err = fmt.Errorf("ts: unknown column %s.%s", ti.Name, column)
+		return
+	}
+	if row < 0 {
+		w.err = fmt.Errorf("ts: invalid row %d for validation of table %q", row, ti.Name)
+		return
+	}
+	w.rowBuffer[ti.ID] = append(w.rowBuffer[ti.ID], encodeValidation(row, column, code, message))
+}
+
+// encodeValidation encodes a validation row:
+//
+//	RS "V" <row-id> <column-size><column> <code> <message-size><message>
+func encodeValidation(row int64, column string, code int64, message string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(asciiRS)
+	buf.WriteByte(byte(RowValidation))
+	binary.Write(buf, binary.LittleEndian, row)
+	binary.Write(buf, binary.LittleEndian, int64(len(column)))
+	buf.WriteString(column)
+	binary.Write(buf, binary.LittleEndian, code)
+	binary.Write(buf, binary.LittleEndian, int64(len(message)))
+	buf.WriteString(message)
+	return buf.Bytes()
+}
+
+var errShortValidation = errors.New("ts: short validation row")
+
+func decodeValidation(row []byte) (v Validation, err error) {
+	pos := 2
+	readInt := func() int64 {
+		if err != nil {
+			return 0
+		}
+		if pos+8 > len(row) {
+			err = errShortValidation
+			return 0
+		}
+		n := int64(binary.LittleEndian.Uint64(row[pos:]))
+		pos += 8
+		return n
+	}
+	readString := func() string {
+		n := readInt()
+		if err != nil {
+			return ""
+		}
+		if n < 0 || int64(pos)+n > int64(len(row)) {
+			err = errShortValidation
+			return ""
+		}
+		s := string(row[pos : pos+int(n)])
+		pos += int(n)
+		return s
+	}
+	v.Row = readInt()
+	v.Column = readString()
+	v.Code = readInt()
+	v.Message = readString()
+	return v, err
+}
+
+// Validations returns the validation rows read so far, in stream order.
+// Validation rows are read from the chunks of every table, including
+// tables skipped by a Cursor.
+func (r *Reader) Validations() []Validation {
+	return r.validations
+}
+
+// RowID returns the ID of the current row. Rows are numbered from one,
+// in the order they were written for their table. Validation rows are
+// not numbered.
+func (r *Reader) RowID() int64 {
+	if r.rt == nil || r.rowIndex < 0 {
+		return 0
+	}
+	return r.rows[r.rowIndex].ID
+}
+
+// RowID returns the ID of the current row.
+func (c *Cursor) RowID() int64 {
+	return c.r.RowID()
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 The Solid Core Data Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ts
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// RowVersion is the first row of a chunk of a table that has been redefined.
+// It holds the version hash of the columns the chunk was written with.
+const RowVersion RowKind = 'H'
+
+// tableVersion returns the hash of the table name and columns.
+func tableVersion(t Table, cols []Col) [32]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %v\n", t.Name, t.Tags)
+	for i, c := range cols {
+		fmt.Fprintf(h, "%d %q %d %d %t %t %d %#v %v\n", i, c.Name, c.Type, c.Link, c.Key, c.Nullable, c.Length, c.Default, c.Tags)
+	}
+	var v [32]byte
+	copy(v[:], h.Sum(nil))
+	return v
+}
+
+// Redefine replaces the columns of table t for the rows written after it.
+// Rows already written are flushed with the previous columns. The table keeps
+// its ID and name; the new definition is written with a new version hash and
+// each following chunk of the table records the version it was written with.
+func (w *Writer) Redefine(t TableRef, cols ...Col) TableRef {
+	if w.err != nil {
+		return errTable
+	}
+	old, ok := w.table[t.id]
+	if !ok || isControl(t.id) {
+		w.err = fmt.Errorf("ts: cannot redefine table %d", t.id)
+		return errTable
+	}
+	w.Flush()
+	ref := w.cdefine(old.ID, old.Table, cols...)
+	if w.err != nil {
+		return errTable
+	}
+	ti := w.table[old.ID]
+	if ti.Version == old.Version {
+		return ref
+	}
+	ti.versioned = true
+	delete(w.keys[controlTableID], keyString(Key{ti.ID}))
+	if !sameKeyColumns(old, ti) {
+		delete(w.keys, ti.ID)
+	}
+	w.insertControl(ti)
+	return ref
+}
+
+// sameKeyColumns reports whether a and b have the same key columns, so the
+// keys written with a are keys of b.
+func sameKeyColumns(a, b *tableInfo) bool {
+	var ka, kb []Col
+	for _, c := range a.Columns {
+		if c.Key {
+			ka = append(ka, c)
+		}
+	}
+	for _, c := range b.Columns {
+		if c.Key {
+			kb = append(kb, c)
+		}
+	}
+	if len(ka) != len(kb) {
+		return false
+	}
+	for i := range ka {
+		if ka[i].Name != kb[i].Name || ka[i].Type != kb[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeVersion encodes a version row:
+//
+//	RS "H" <version-hash>
+func encodeVersion(v [32]byte) []byte {
+	row := make([]byte, 0, 2+len(v))
+	row = append(row, asciiRS, byte(RowVersion))
+	return append(row, v[:]...)
+}
+
+// versionColumns are the columns and tags of a version of a table.
+type versionColumns struct {
+	tags    Tags
+	columns []*readColumn
+}
+
+// setVersion switches rt to version v. The columns of the current version
+// are kept so chunks written with them can still be read. If define is set
+// the columns of the version are about to be read, so the table starts the
+// version without columns.
+func (rt *readTable) setVersion(v [32]byte, define bool) error {
+	if v == rt.version {
+		return nil
+	}
+	if rt.versions == nil {
+		rt.versions = make(map[[32]byte]*versionColumns)
+	}
+	rt.versions[rt.version] = &versionColumns{tags: rt.Tags, columns: rt.columns}
+	vc, ok := rt.versions[v]
+	switch {
+	case define:
+		vc = &versionColumns{}
+	case !ok:
+		return fmt.Errorf("ts: unknown version %x of table %q", v[:4], rt.Name)
+	}
+	rt.version = v
+	rt.Tags = vc.tags
+	rt.columns = vc.columns
+	rt.update()
+	return nil
+}
+
+var errShortVersion = errors.New("ts: short version row")
+
+// chunkVersion switches rt to the version recorded in the first row of the
+// chunk, if any.
+func (r *Reader) chunkVersion(rt *readTable) error {
+	if len(r.rows) == 0 || RowKind(r.rows[0].Type) != RowVersion {
+		return nil
+	}
+	start := r.rows[0].Offset
+	end := int64(len(r.chunk))
+	if len(r.rows) > 1 {
+		end = r.rows[1].Offset
+	}
+	row := r.chunk[start:end]
+	if len(row) != 2+32 || !bytes.Equal(row[:2], []byte{asciiRS, byte(RowVersion)}) {
+		return errShortVersion
+	}
+	var v [32]byte
+	copy(v[:], row[2:])
+	return rt.setVersion(v, false)
+}
+
+// Version returns the version hash of the columns of the current row's table.
+func (r *Reader) Version() [32]byte {
+	if r.rt == nil {
+		return [32]byte{}
+	}
+	return r.rt.version
+}
@@ -7,6 +7,7 @@ package ts
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
@@ -17,11 +18,27 @@ type tableInfo struct {
 	Table
 	Columns      []Col
 	ColumnByName map[string]*Col
+
+	Version   [32]byte // Hash of the table and columns.
+	versioned bool     // Chunks start with a version row.
 }
 
+// columnIndex returns the position of the named column or -1 if the column
+// is not in the table.
+func (ti *tableInfo) columnIndex(name string) int {
+	for i := range ti.Columns {
+		if ti.Columns[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Writer encodes tables into a ts stream.
 type Writer struct {
 	err error
 	w   io.Writer
+	out *countWriter // Counts the bytes written to w.
 
 	chunksWritten int64
 	chunkBuffer   *bytes.Buffer
@@ -34,6 +51,25 @@ type Writer struct {
 	// rowBuffer is written to by the Insert call, then written to disk
 	// and emptied on Flush.
 	rowBuffer map[int64][][]byte // map[tableID][]RowData
+
+	// pending holds the rows of rowBuffer that are encoded on Flush,
+	// see Parallel.
+	pending map[int64][]pendingRow
+
+	rowEncoder RowEncoder
+	rowBuilder rowBuilder // Encodes rows written without Parallel.
+
+	headerWritten bool
+	inGroup       bool
+
+	parallel int // Goroutines used by Flush.
+
+	check bool
+	keys  map[int64]map[string]bool // Keys written by table ID, see CheckIntegrity.
+
+	index      bool           // Write a key index, see KeyIndex.
+	indexChunk []indexEntry   // Chunks written for the key index.
+	tags       map[Tag]string // Defined tag names.
 }
 type chunk struct {
 	readOffset int64
@@ -49,14 +85,19 @@ type valueChunk struct {
 }
 
 func NewWriter(w io.Writer) *Writer {
+	out := &countWriter{w: w}
 	e := &Writer{
-		w:           w,
+		w:           out,
+		out:         out,
 		chunkBuffer: &bytes.Buffer{},
 		rowID:       make(map[int64]int64, 10),
 		table:       make(map[int64]*tableInfo, 10),
 		control:     make(map[int64]TableRef, 10),
 		field:       make(map[Type]FieldCoder, 10),
 		rowBuffer:   make(map[int64][][]byte, 10),
+		pending:     make(map[int64][]pendingRow, 10),
+		keys:        make(map[int64]map[string]bool, 10),
+		tags:        map[Tag]string{TagHidden: "hidden"},
 	}
 	e.initControl()
 	return e
@@ -93,86 +134,94 @@ func (w *Writer) csetup(tid int64, t Table, c ...Col) TableRef {
 		panic(fmt.Errorf("%s.id incorrect: wanted %d, got %d", t.Name, tid, tref.id))
 	}
 	w.control[tid] = tref
+	if w.rowID[controlTableID] < tid {
+		w.rowID[controlTableID] = tid
+	}
 	return tref
 }
 
+type controlDef struct {
+	ID      int64
+	Table   Table
+	Columns []Col
+}
+
+// controlDefs are the definitions of the control tables. Both the writer and
+// the reader start with these definitions.
+var controlDefs = []controlDef{
+	{controlVersionID, Table{Name: "control/version"}, []Col{
+		{Name: "version", Type: Hash},
+	}},
+	{controlTagID, Table{Name: "control/tag"}, []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "name", Type: String},
+	}},
+	{controlTableID, Table{Name: "control/table"}, []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "version", Type: Hash, Default: Zero},
+		{Name: "name", Type: String},
+		{Name: "comment", Type: String, Default: Zero},
+	}},
+	{controlTableTagID, Table{Name: "control/table/tag"}, []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "table", Type: Int64},
+		{Name: "tag", Type: Int64},
+	}},
+	{controlFieldTypeID, Table{Name: "control/fieldtype"}, []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "bit_size", Type: Int64},
+		{Name: "name", Type: String},
+	}},
+	{controlColumnID, Table{Name: "control/column"}, []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "version", Type: Hash, Default: Zero, Tags: Tags{TagHidden}},
+		{Name: "table", Type: Int64},
+		{Name: "fieldtype", Type: Int64},
+		{Name: "link", Type: Int64, Nullable: true},
+		{Name: "key", Type: Bool, Default: Zero},
+		{Name: "nullable", Type: Bool, Default: Zero},
+		{Name: "length", Type: Int64, Default: Zero, Comment: "For strings this is the number of allowed runes. For bytes it is the byte count."},
+		{Name: "fixed_bit_size", Type: Int64, Default: Zero, Tags: Tags{TagHidden}},
+		{Name: "sort_order", Type: Int64, Default: Zero},
+		{Name: "name", Type: String},
+		{Name: "default", Type: Any, Nullable: true},
+		{Name: "comment", Type: String, Default: Zero},
+	}},
+	{controlColumnTagID, Table{Name: "control/column/tag"}, []Col{
+		{Name: "id", Type: Int64, Key: true},
+		{Name: "column", Type: Int64},
+		{Name: "tag", Type: Int64},
+	}},
+}
+
 // initControl created the control tables and initial data. This must be done
 // in two steps, the first to define all the internal structures, the second
 // to create the rows within the internal structures.
 func (w *Writer) initControl() {
-	version := w.csetup(controlVersionID, Table{Name: "control/version"},
-		Col{Name: "version", Type: Hash},
-	)
-
-	tag := w.csetup(controlTagID, Table{Name: "control/tag"},
-		Col{Name: "id", Type: Int64, Key: true},
-		Col{Name: "name", Type: String},
-	)
-
-	table := w.csetup(controlTableID, Table{Name: "control/table"},
-		Col{Name: "id", Type: Int64, Key: true},
-		Col{Name: "version", Type: Hash, Default: Zero},
-		Col{Name: "name", Type: String},
-		Col{Name: "comment", Type: String, Default: Zero},
-	)
-
-	tableTag := w.csetup(controlTableTagID, Table{Name: "control/table/tag"},
-		Col{Name: "id", Type: Int64, Key: true},
-		Col{Name: "table", Type: Int64},
-		Col{Name: "tag", Type: Int64},
-	)
-
-	fieldtype := w.csetup(controlFieldTypeID, Table{Name: "control/fieldtype"},
-		Col{Name: "id", Type: Int64, Key: true},
-		Col{Name: "bit_size", Type: Int64},
-		Col{Name: "name", Type: String},
-	)
-
-	column := w.csetup(controlColumnID, Table{Name: "control/column"},
-		Col{Name: "id", Type: Int64, Key: true},
-		Col{Name: "version", Type: Hash, Default: Zero, Tags: Tags{TagHidden}},
-		Col{Name: "table", Type: Int64},
-		Col{Name: "fieldtype", Type: Int64},
-		Col{Name: "link", Type: Int64, Nullable: true},
-		Col{Name: "key", Type: Bool, Default: Zero},
-		Col{Name: "nullable", Type: Bool, Default: Zero},
-		Col{Name: "length", Type: Int64, Default: Zero, Comment: "For strings this is the number of allowed runes. For bytes it is the byte count."},
-		Col{Name: "fixed_bit_size", Type: Int64, Default: Zero, Tags: Tags{TagHidden}},
-		Col{Name: "sort_order", Type: Int64, Default: Zero},
-		Col{Name: "name", Type: String},
-		Col{Name: "default", Type: Any, Nullable: true},
-		Col{Name: "comment", Type: String, Default: Zero},
-	)
-
-	columnTag := w.csetup(controlColumnTagID, Table{Name: "control/column/tag"},
-		Col{Name: "id", Type: Int64, Key: true},
-		Col{Name: "column", Type: Int64},
-		Col{Name: "tag", Type: Int64},
-	)
-	_ = table
-	_ = tableTag
-	_ = column
-	_ = columnTag
-	_ = fieldtype
+	for _, cd := range controlDefs {
+		cols := make([]Col, len(cd.Columns))
+		copy(cols, cd.Columns)
+		w.csetup(cd.ID, cd.Table, cols...)
+	}
+
+	for _, ft := range builtinFieldTypes {
+		w.field[ft.Type] = ft.Coder
+	}
+	for _, ft := range builtinFieldTypes {
+		w.addFieldType(ft.Type, ft.Name, ft.Coder)
+	}
 
 	// Loop through all the tables added so far and insert the table and column rows.
 	for _, tid := range w.tableIDList() {
 		w.insertControl(w.table[tid])
 	}
 
-	w.Insert(tag, TagHidden, "hidden")
-
-	w.addFieldType(Hash, "hash", coderHash{})
-	w.addFieldType(Int64, "int64", coderInt64{})
-	w.addFieldType(Bool, "bool", coderBool{})
-	w.addFieldType(String, "string", coderString{})
-	w.addFieldType(Bytes, "bytes", coderBytes{})
-	w.addFieldType(Any, "any", coderAny{})
+	w.Insert(w.control[controlTagID], TagHidden, "hidden")
 
 	w.Flush()
 
 	// TODO(kardianos): Calculate hash of control/*.
-	w.Insert(version, 0)
+	w.Insert(w.control[controlVersionID], Zero)
 }
 
 func (w *Writer) addFieldType(ftid Type, name string, fc FieldCoder) {
@@ -201,12 +250,42 @@ func (t TableRef) Use(columns ...string) TableRef {
 	return ut
 }
 
+// ID returns the table ID. A column links to a table by its ID.
+func (t TableRef) ID() int64 {
+	return t.id
+}
+
+// Lookup returns the table with the given name, including control tables.
+func (w *Writer) Lookup(name string) (TableRef, bool) {
+	for _, tid := range w.tableIDList() {
+		ti := w.table[tid]
+		if ti.Name != name {
+			continue
+		}
+		all := make(map[string]bool, len(ti.Columns))
+		names := make([]string, len(ti.Columns))
+		for i, c := range ti.Columns {
+			all[c.Name] = true
+			names[i] = c.Name
+		}
+		return TableRef{id: tid, all: all, col: names}, true
+	}
+	return errTable, false
+}
+
 type Table struct {
 	Name    string
 	Comment string
 	Tags    Tags
 }
 
+// TableDef is the definition of a table and its columns.
+type TableDef struct {
+	ID int64 // Table ID within a stream, zero if not read from a stream.
+	Table
+	Columns []Col
+}
+
 type Col struct {
 	Name string
 	Type Type
@@ -230,6 +309,21 @@ type RowRef struct {
 var errTable = TableRef{id: -1}
 var errRow = RowRef{id: -1}
 
+// writeTable returns the table rows of t are written to. It sets w.err and
+// returns nil if t selects invalid column names or is not a table of w.
+func (w *Writer) writeTable(t TableRef) *tableInfo {
+	if len(t.invalid) > 0 {
+		w.err = fmt.Errorf("ts: invalid table names: %q", t.invalid)
+		return nil
+	}
+	ti := w.table[t.id]
+	if ti == nil {
+		w.err = fmt.Errorf("ts: unknown table %d", t.id)
+		return nil
+	}
+	return ti
+}
+
 func (w *Writer) cdefine(tid int64, t Table, cols ...Col) TableRef {
 	if w.err != nil {
 		return errTable
@@ -244,6 +338,7 @@ func (w *Writer) cdefine(tid int64, t Table, cols ...Col) TableRef {
 		Columns:      cols,
 		ColumnByName: make(map[string]*Col, len(cols)),
 	}
+	ti.Version = tableVersion(t, cols)
 	w.table[tid] = ti
 
 	for i, c := range cols {
@@ -264,22 +359,31 @@ func (w *Writer) insertControl(ti *tableInfo) {
 	ttagref := w.control[controlTableTagID]
 	cref := w.control[controlColumnID]
 	ctagref := w.control[controlColumnTagID]
-	w.Insert(tref, ti.ID, 0, ti.Name, ti.Comment)
+	w.Insert(tref, ti.ID, ti.Version, ti.Name, ti.Comment)
 
 	for _, tag := range ti.Tags {
-		// TODO(kardianos): Verify tag is valid.
+		w.checkTag(ti.Name, "", tag)
 		ttagid := w.nextRowID(controlTableTagID)
 		w.Insert(ttagref, ttagid, ti.ID, tag)
 	}
 	for i, c := range ti.Columns {
 		rid := w.nextRowID(controlColumnID)
-		fixed_bit_size := int64(0) // TODO(kardianos): Calc hash and fixed_bit_size.
+		fc, ok := w.field[c.Type]
+		if !ok {
+			w.err = fmt.Errorf("ts: unknown type %d for %s.%s", c.Type, ti.Name, c.Name)
+			return
+		}
+		fixed_bit_size := fc.BitSize() // TODO(kardianos): Calc hash.
 		sort_order := int64(i + 1)
+		var link interface{}
+		if c.Link != 0 {
+			link = c.Link
+		}
 
-		w.Insert(cref, rid, 0, ti.ID, c.Type, c.Link, c.Key, c.Nullable, c.Length, fixed_bit_size, sort_order, c.Name, c.Default, c.Comment)
+		w.Insert(cref, rid, ti.Version, ti.ID, c.Type, link, c.Key, c.Nullable, c.Length, fixed_bit_size, sort_order, c.Name, c.Default, c.Comment)
 
 		for _, tag := range c.Tags {
-			// TODO(kardianos): Verify tag is valid.
+			w.checkTag(ti.Name, c.Name, tag)
 			rtagid := w.nextRowID(controlColumnTagID)
 			w.Insert(ctagref, rtagid, rid, tag)
 		}
@@ -298,6 +402,17 @@ func (w *Writer) Define(t Table, cols ...Col) TableRef {
 	return ref
 }
 
+// writeHeader writes the file header if it has not been written.
+func (w *Writer) writeHeader() {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+	if _, err := w.w.Write(fileHeader); err != nil {
+		w.err = err
+	}
+}
+
 func (w *Writer) Flush() {
 	if w.err != nil {
 		return
@@ -306,53 +421,42 @@ func (w *Writer) Flush() {
 		return
 	}
 
-	if w.chunksWritten == 0 {
-		w.w.Write(fileHeader)
-	}
+	w.writeHeader()
 
-	type offset struct {
-		Type   byte
-		Offset int64
+	tids := w.rowBufferTID()
+	if len(w.pending) > 0 {
+		if err := w.encodePending(tids); err != nil {
+			w.err = err
+			return
+		}
 	}
-
-	cb := w.chunkBuffer
-
-	for _, tid := range w.rowBufferTID() {
+	tables := make([][][]byte, len(tids))
+	for i, tid := range tids {
 		rows := w.rowBuffer[tid]
 		delete(w.rowBuffer, tid)
+		if ti := w.table[tid]; ti != nil && ti.versioned {
+			rows = append([][]byte{encodeVersion(ti.Version)}, rows...)
+		}
+		tables[i] = rows
+	}
 
-		sizeOfRowOffset := 8
-		sizeOfRowType := 1
-
-		sizeOfTableID := 8
-		sizeOfRowCount := 8
-		sizeOfPerRowHeader := sizeOfRowType + sizeOfRowOffset
-
-		// TODO(kardianos): In the future there may be a another loop to split many buffered rows into multiple chunks.
+	// TODO(kardianos): In the future there may be a another loop to split many buffered rows into multiple chunks.
 
-		headerSize := sizeOfTableID + sizeOfRowCount + (len(rows) * sizeOfPerRowHeader)
-		chunkSize := int64(headerSize)
-		oo := make([]offset, len(rows))
-		for ri, r := range rows {
-			if len(r) < 2 {
-				w.err = fmt.Errorf("invalid row length (%d) for tid=%d", len(r), tid)
-				return
-			}
-			oo[ri].Type = r[1]
-			oo[ri].Offset = chunkSize
-			chunkSize += int64(len(r))
+	cb := w.chunkBuffer
+	for i, tid := range tids {
+		rows := tables[i]
+		header, _, err := chunkHeader(tid, rows)
+		if err != nil {
+			w.err = err
+			return
 		}
-
+		w.addIndex(tid, rows)
 		cb.Reset()
-		cb.Write(markerChunk)
-		binary.Write(cb, binary.LittleEndian, chunkSize)
-		binary.Write(cb, binary.LittleEndian, tid)
-		binary.Write(cb, binary.LittleEndian, len(rows))
-
+		cb.Write(header)
 		for _, r := range rows {
 			cb.Write(r)
 		}
-		_, err := cb.WriteTo(w.w)
+		_, err = cb.WriteTo(w.w)
 		if err != nil {
 			w.err = err
 			return
@@ -362,10 +466,48 @@ func (w *Writer) Flush() {
 	cb.Reset()
 }
 
+// chunkHeader returns the chunk marker, chunk length and chunk header for
+// the rows of table tid, and the total size of the chunk including the rows.
+func chunkHeader(tid int64, rows [][]byte) ([]byte, int64, error) {
+	sizeOfRowOffset := 8
+	sizeOfRowType := 1
+
+	sizeOfTableID := 8
+	sizeOfRowCount := 8
+	sizeOfPerRowHeader := sizeOfRowType + sizeOfRowOffset
+
+	headerSize := sizeOfTableID + sizeOfRowCount + (len(rows) * sizeOfPerRowHeader)
+	chunkSize := int64(headerSize)
+	for _, r := range rows {
+		if len(r) < 2 {
+			return nil, 0, fmt.Errorf("invalid row length (%d) for tid=%d", len(r), tid)
+		}
+		chunkSize += int64(len(r))
+	}
+
+	prefix := len(markerChunk) + 8
+	header := make([]byte, prefix+headerSize)
+	copy(header, markerChunk)
+	binary.LittleEndian.PutUint64(header[2:], uint64(chunkSize))
+	binary.LittleEndian.PutUint64(header[10:], uint64(tid))
+	binary.LittleEndian.PutUint64(header[18:], uint64(len(rows)))
+	at := 26
+	offset := int64(headerSize)
+	for _, r := range rows {
+		header[at] = r[1]
+		binary.LittleEndian.PutUint64(header[at+1:], uint64(offset))
+		at += sizeOfPerRowHeader
+		offset += int64(len(r))
+	}
+	return header, int64(prefix) + chunkSize, nil
+}
+
 func (w *Writer) Cancel() error {
 	if w.err != nil {
 		return w.err
 	}
+	w.rowBuffer = make(map[int64][][]byte, 10)
+	w.pending = make(map[int64][]pendingRow, 10)
 	_, err := w.w.Write(fileCancel)
 	if err != nil {
 		w.err = err
@@ -375,6 +517,14 @@ func (w *Writer) Cancel() error {
 }
 
 func (w *Writer) Close() error {
+	w.Flush()
+	if w.err == nil && w.inGroup {
+		w.err = errors.New("ts: close with an open group")
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.writeIndex()
 	if w.err != nil {
 		return w.err
 	}
@@ -397,43 +547,150 @@ func (w *Writer) Error() error {
 	return w.err
 }
 
+// Insert writes a data row with values for the columns selected in t.
+// If the table has a single Int64 key column and the key is not selected
+// or is nil, the key is assigned from the next row ID of the table.
+// The returned RowRef may be used as the value of a link column.
 func (w *Writer) Insert(t TableRef, values ...interface{}) RowRef {
 	if w.err != nil {
 		return errRow
 	}
-	if len(t.invalid) > 0 {
-		w.err = fmt.Errorf("st: invalid table names: %q", t.invalid)
+	ti := w.writeTable(t)
+	if ti == nil {
 		return errRow
 	}
-
 	if len(t.col) != len(values) {
 		w.err = fmt.Errorf("ts: expected %d values, got %d values", len(t.col), len(values))
 		return errRow
 	}
-	ti := w.table[t.id]
+	names, values := w.autoKey(ti, t.col, values)
+	return w.writeRow(ti, RowData, names, values)
+}
 
-	// TODO(kardianos): Encode values row to w.rowBuffer.
-	cb := w.chunkBuffer
-	cb.Reset()
-	cb.Write(markerRow)
+// encodeRow encodes a single row starting with the row marker.
+//
+// The row marker is followed by a bit-mask with one bit for each column, set
+// if the column has a value. Update rows follow this with a second bit-mask,
+// set if the update sets the column to null. Each column with a value then
+// follows in column order.
+// Fixed length columns are written in the number of bytes needed for the field
+// bit size. Variable length columns are prefixed with the value size in bytes.
+//
+// For data rows a nil value leaves the column empty. For update rows a nil
+// value sets the column to null.
+func (w *Writer) encodeRow(rb *rowBuilder, ti *tableInfo, kind RowKind, names []string, values []interface{}) ([]byte, error) {
+	rb.reset(len(ti.Columns))
+	present, has, null := rb.present, rb.has, rb.null
+	for i, name := range names {
+		ci := ti.columnIndex(name)
+		if ci < 0 {
+			return nil, fmt.Errorf("ts: unknown column %s.%s", ti.Name, name)
+		}
+		if values[i] == nil {
+			if kind == RowUpdate {
+				if !ti.Columns[ci].Nullable {
+					return nil, fmt.Errorf("ts: cannot set %s.%s to null", ti.Name, name)
+				}
+				null[ci] = true
+			}
+			continue
+		}
+		present[ci] = values[i]
+		has[ci] = true
+	}
+
+	cb := &rb.buf
+	cb.Write([]byte{asciiRS, byte(kind)})
 
-	// Decide which columns have values.
 	// Encode the value bit-mask prefix.
-	// Loop through each column and write it to the buffer.
 	emptyBitmaskLength := len(ti.Columns) / 8
 	if len(ti.Columns)%8 != 0 {
 		emptyBitmaskLength++
 	}
+	mask := rb.mask(2 * emptyBitmaskLength)
+	mask, nullMask := mask[:emptyBitmaskLength], mask[emptyBitmaskLength:]
+	for i, c := range ti.Columns {
+		if has[i] {
+			mask[i/8] |= 1 << uint(i%8)
+			continue
+		}
+		if null[i] {
+			nullMask[i/8] |= 1 << uint(i%8)
+			continue
+		}
+		if kind == RowData && !c.Nullable && c.Default == nil {
+			return nil, fmt.Errorf("ts: missing value for %s.%s", ti.Name, c.Name)
+		}
+	}
+	cb.Write(mask)
+	if kind == RowUpdate {
+		cb.Write(nullMask)
+	}
+
+	// Loop through each column and write it to the buffer.
+	var size [8]byte
+	var err error
 	for i := range ti.Columns {
-		_ = i
+		if !has[i] {
+			continue
+		}
+		c := &ti.Columns[i]
+		fc, ok := w.field[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("ts: unknown type %d for %s.%s", c.Type, ti.Name, c.Name)
+		}
+		rb.value, err = fc.Encode(c, rb.value, present[i])
+		if err != nil {
+			return nil, fmt.Errorf("%v in %s.%s", err, ti.Name, c.Name)
+		}
+		if fc.BitSize() == 0 {
+			binary.LittleEndian.PutUint64(size[:], uint64(len(rb.value)))
+			cb.Write(size[:])
+		}
+		cb.Write(rb.value)
 	}
 
 	rowdata := make([]byte, cb.Len())
 	copy(rowdata, cb.Bytes())
-	w.rowBuffer[t.id] = append(w.rowBuffer[t.id], rowdata)
+	return rowdata, nil
+}
 
-	return RowRef{
-		table: t.id,
-		id:    -1, // TODO(kardianos): Determine the correct ID, ensure it is greater or equal to the current row table ID.
+// rowBuilder holds the buffers used to encode a row, reused for each row.
+type rowBuilder struct {
+	buf     bytes.Buffer
+	present []interface{}
+	has     []bool
+	null    []bool
+	masks   []byte
+	value   []byte
+}
+
+// reset prepares rb to encode a row of a table with n columns.
+func (rb *rowBuilder) reset(n int) {
+	rb.buf.Reset()
+	if cap(rb.present) < n {
+		rb.present = make([]interface{}, n)
+		rb.has = make([]bool, n)
+		rb.null = make([]bool, n)
+	}
+	rb.present = rb.present[:n]
+	rb.has = rb.has[:n]
+	rb.null = rb.null[:n]
+	for i := 0; i < n; i++ {
+		rb.present[i] = nil
+		rb.has[i] = false
+		rb.null[i] = false
+	}
+}
+
+// mask returns n zero bytes for the bit-masks of a row.
+func (rb *rowBuilder) mask(n int) []byte {
+	if cap(rb.masks) < n {
+		rb.masks = make([]byte, n)
+	}
+	rb.masks = rb.masks[:n]
+	for i := range rb.masks {
+		rb.masks[i] = 0
 	}
+	return rb.masks
 }